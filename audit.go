@@ -0,0 +1,158 @@
+package taskeeper
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//DefaultAuditLines 查询审计日志时默认返回的条数
+const DefaultAuditLines = 50
+
+//查询审计日志时最多读取文件末尾的字节数
+const auditTailSize = 256 * 1024
+
+var (
+	//auditPath 审计日志文件 每条记录一行json 只追加写入 为空时不写入
+	auditPath string
+	//auditLock 审计日志的读写锁
+	auditLock sync.Mutex
+	//auditReads 是否记录成功的查询请求 默认记录所有请求
+	auditReads = true
+)
+
+//AuditEntry 审计日志的一条记录
+type AuditEntry struct {
+	Time      string    `json:"time"`               //请求时间
+	Peer      string    `json:"peer"`               //客户端地址
+	Cred      *PeerCred `json:"cred,omitempty"`     //unix socket客户端的进程信息
+	Identity  string    `json:"identity,omitempty"` //校验后的身份 用户名 证书CN或token类型
+	Method    string    `json:"method"`             //请求的方法
+	Target    string    `json:"target,omitempty"`   //目标命令
+	Code      int       `json:"code"`               //结果的错误编号 0为成功
+	LatencyMs float64   `json:"latency_ms"`         //处理耗时 毫秒
+}
+
+//PeerCred unix socket客户端的进程信息 只在linux下获取
+type PeerCred struct {
+	PID int `json:"pid"`
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+//读取审计日志的配置
+//audit_log 审计日志文件 默认与pid文件在同一目录 audit_reads 为false时不记录成功的查询请求
+func loadAuditConfig(cnf *configurator.Config) {
+	auditReads = cnf.Get("audit_reads").IsNil() || getBool(cnf.Get("audit_reads"))
+	path, _ := cnf.Get("audit_log").String()
+	if path == "" {
+		auditPath = filepath.Join(filepath.Dir(statePath), "taskeeper.audit.log")
+		return
+	}
+	auditPath = getAbsPath(path)
+}
+
+//是否需要记录审计日志 关闭查询记录时只记录控制操作和校验失败的请求
+func needAudit(method string, code int) bool {
+	return auditReads || methodPerm(method) == PermAdmin || code == ErrResAuth || code == ErrResDenied
+}
+
+//记录一次请求的审计日志
+func auditRequest(p *peer, identity, method, target string, code int, start time.Time) {
+	if !needAudit(method, code) {
+		return
+	}
+	e := AuditEntry{
+		Time:      start.Format(time.RFC3339Nano),
+		Peer:      p.addr,
+		Cred:      p.cred,
+		Identity:  identity,
+		Method:    method,
+		Target:    target,
+		Code:      code,
+		LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	level := LevelInfo
+	if code != ErrResCodeNo {
+		level = LevelWarn
+	}
+	logEvent(newEvent(level, EventAudit, nil, "audit "+p.String()+" "+method+" "+target+" code "+strconv.Itoa(code)))
+	if err := writeAudit(e); err != nil {
+		logEvent(newEvent(LevelError, EventAudit, nil, "audit log write failed : "+err.Error()))
+	}
+}
+
+//追加写入一条审计记录 每次写入时打开文件 便于外部切割
+func writeAudit(e AuditEntry) error {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if auditPath == "" {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//读取最近的n条审计记录 n不大于0时使用默认条数
+func readAudit(n int) []AuditEntry {
+	if n <= 0 {
+		n = DefaultAuditLines
+	}
+	list := []AuditEntry{}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	f, err := os.Open(auditPath)
+	if err != nil {
+		return list
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return list
+	}
+	offset := info.Size() - auditTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		return list
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return list
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'})
+	//从文件中间开始读取时 第一行可能不完整
+	if offset > 0 && len(lines) > 0 {
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for _, line := range lines {
+		var e AuditEntry
+		if json.Unmarshal(line, &e) == nil {
+			list = append(list, e)
+		}
+	}
+	return list
+}
@@ -0,0 +1,103 @@
+package taskeeper
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskeeper-audit")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	oldPath := auditPath
+	auditPath = filepath.Join(dir, "audit.log")
+	defer func() {
+		auditPath = oldPath
+	}()
+	defer setTestTokens("admin-token", "read-token")()
+
+	p := &peer{addr: "127.0.0.1:1234"}
+	dispatch(p, "read-token", MethodStatus, RequestParams{})
+	dispatch(p, "wrong", MethodStatus, RequestParams{})
+	dispatch(p, "read-token", MethodStop, RequestParams{Name: "web"})
+	dispatch(p, "admin-token", MethodStop, RequestParams{Name: "nosuch"})
+
+	//默认记录所有请求
+	list := readAudit(0)
+	want := []struct {
+		identity string
+		method   string
+		code     int
+	}{
+		{"auth_readonly_token", MethodStatus, ErrResCodeNo},
+		{"", MethodStatus, ErrResAuth},
+		{"auth_readonly_token", MethodStop, ErrResDenied},
+		{"auth_token", MethodStop, ErrResNoCmd},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("audit entries %d, want %d", len(list), len(want))
+	}
+	for i, w := range want {
+		e := list[i]
+		if e.Peer != p.addr || e.Identity != w.identity || e.Method != w.method || e.Code != w.code || e.Time == "" {
+			t.Errorf("entry %d : %+v", i, e)
+		}
+	}
+	if list[3].Target != "nosuch" {
+		t.Errorf("target %q", list[3].Target)
+	}
+
+	//文本协议查询最近的记录
+	res, code, _ := msgProcess([]byte("stat audit 1"))
+	recent, ok := res.([]AuditEntry)
+	if code != ErrResCodeNo || !ok || len(recent) != 1 || recent[0].Target != "nosuch" {
+		t.Errorf("stat audit : %d %v", code, res)
+	}
+
+	//关闭查询记录后 成功的查询不记录
+	auditReads = false
+	defer func() {
+		auditReads = true
+	}()
+	dispatch(p, "read-token", MethodStatus, RequestParams{})
+	dispatch(p, "wrong", MethodStatus, RequestParams{})
+	if n := len(readAudit(100)); n != len(want)+2 {
+		t.Errorf("audit entries %d with reads disabled, want %d", n, len(want)+2)
+	}
+}
+
+func TestUnixPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials only on linux")
+	}
+	dir, err := ioutil.TempDir("", "taskeeper-cred")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	ln, err := net.Listen("unix", filepath.Join(dir, "test.sock"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+	conn, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	c, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer c.Close()
+	p := connPeer(c)
+	if p.cred == nil || p.cred.PID != os.Getpid() || p.cred.UID != os.Getuid() {
+		t.Errorf("peer cred %+v", p.cred)
+	}
+}
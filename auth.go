@@ -0,0 +1,214 @@
+package taskeeper
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//权限级别
+const (
+	PermNone  = 0 //没有权限
+	PermRead  = 1 //只能查询
+	PermAdmin = 2 //可以查询和控制
+)
+
+//MsgAuth 文本协议中携带token的前缀 `auth {token} ctl reload`
+const MsgAuth = "auth"
+
+//只需要查询权限的方法
+var readMethods = map[string]bool{
+	MethodStatus:    true,
+	MethodCommands:  true,
+	MethodCommand:   true,
+	MethodOutput:    true,
+	MethodConfig:    true,
+	StatTail:        true,
+	MethodAudit:     true,
+	MethodSubscribe: true,
+	MethodMetrics:   true,
+}
+
+var (
+	//authTokenSum 管理token的摘要 为空时不校验
+	authTokenSum []byte
+	//authReadTokenSum 只读token的摘要
+	authReadTokenSum []byte
+)
+
+//peer 发送请求的客户端
+type peer struct {
+	addr     string    //客户端地址
+	identity string    //客户端证书的CN
+	perm     int       //客户端证书对应的权限
+	trusted  bool      //unix socket的访问由文件权限控制 没有配置用户时不需要校验token
+	cred     *PeerCred //unix socket客户端的进程信息
+}
+
+//keeper进程内部的请求
+var localPeer = &peer{addr: "local", trusted: true}
+
+//按连接创建客户端信息 tls连接会先完成握手
+func connPeer(c net.Conn) *peer {
+	if uc, ok := c.(*net.UnixConn); ok {
+		return &peer{addr: "unix:" + sockPath, trusted: true, cred: unixPeerCred(uc)}
+	}
+	p := &peer{addr: c.RemoteAddr().String()}
+	if tc, ok := c.(*tls.Conn); ok {
+		tlsPeer(tc, p)
+	}
+	return p
+}
+
+//客户端的描述 用于日志
+func (p *peer) String() string {
+	if p.identity != "" {
+		return p.addr + " (" + p.identity + ")"
+	}
+	if p.cred != nil {
+		return p.addr + " (pid " + strconv.Itoa(p.cred.PID) + " uid " + strconv.Itoa(p.cred.UID) + ")"
+	}
+	return p.addr
+}
+
+//校验客户端是否可以对目标执行方法
+//返回客户端的身份 失败时返回错误消息和错误编号
+func (p *peer) authorize(token, method, target string) (string, string, int) {
+	if p == localPeer || !authRequired() {
+		return p.identity, "", ErrResCodeNo
+	}
+	//配置了用户时 unix socket客户端同样按用户的角色校验
+	if p.trusted && len(rbacUsers) == 0 {
+		return p.identity, "", ErrResCodeNo
+	}
+	//配置了用户时 优先按用户的角色校验
+	if u := p.roleUser(token); u != nil {
+		if !u.allowed(method, target) {
+			logEvent(newEvent(LevelWarn, EventAuth, nil, "auth rejected "+p.String()+" : user "+u.name+" can not "+method+" "+target))
+			return u.name, ErrMsgMap[ErrResDenied] + " : {" + method + " " + target + "}", ErrResDenied
+		}
+		return u.name, "", ErrResCodeNo
+	}
+	//token和客户端证书取较高的权限
+	identity := p.identity
+	perm := tokenPerm(token)
+	switch perm {
+	case PermAdmin:
+		identity = "auth_token"
+	case PermRead:
+		identity = "auth_readonly_token"
+	}
+	if p.perm > perm {
+		identity, perm = p.identity, p.perm
+	}
+	if perm == PermNone {
+		logEvent(newEvent(LevelWarn, EventAuth, nil, "auth rejected "+p.String()+" : invalid token for "+method))
+		return identity, ErrMsgMap[ErrResAuth], ErrResAuth
+	}
+	if perm < methodPerm(method) {
+		logEvent(newEvent(LevelWarn, EventAuth, nil, "auth rejected "+p.String()+" : read-only access for "+method))
+		return identity, ErrMsgMap[ErrResDenied] + " : {" + method + "}", ErrResDenied
+	}
+	return identity, "", ErrResCodeNo
+}
+
+//客户端对应的用户 按token 客户端证书CN和unix socket客户端的uid查找
+//keeper内部的请求和没有配置用户时返回nil
+func (p *peer) roleUser(token string) *rbacUser {
+	if p == localPeer || len(rbacUsers) == 0 {
+		return nil
+	}
+	return findUser(token, p.identity, p.cred)
+}
+
+//是否需要校验 配置了token 用户 或者开启了客户端证书校验
+func authRequired() bool {
+	return authTokenSum != nil || authReadTokenSum != nil || len(rbacUsers) > 0 || clientCertEnabled()
+}
+
+//方法需要的权限
+func methodPerm(method string) int {
+	if readMethods[method] {
+		return PermRead
+	}
+	return PermAdmin
+}
+
+//token对应的权限 使用摘要按固定时间比较
+func tokenPerm(token string) int {
+	if token == "" {
+		return PermNone
+	}
+	sum := tokenSum(token)
+	if authTokenSum != nil && subtle.ConstantTimeCompare(sum, authTokenSum) == 1 {
+		return PermAdmin
+	}
+	if authReadTokenSum != nil && subtle.ConstantTimeCompare(sum, authReadTokenSum) == 1 {
+		return PermRead
+	}
+	return PermNone
+}
+
+//token的摘要 比较时不暴露token的长度
+func tokenSum(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+//分离文本消息中的token `auth {token} {msg}`
+func splitLegacyToken(msg []byte) (string, []byte) {
+	fields := strings.SplitN(strings.TrimLeft(string(msg), " "), " ", 3)
+	if len(fields) < 3 || fields[0] != MsgAuth {
+		return "", msg
+	}
+	return fields[1], []byte(fields[2])
+}
+
+//读取token配置
+//auth_token auth_token_file 管理token auth_readonly_token auth_readonly_token_file 只读token
+func loadAuthConfig(cnf *configurator.Config) error {
+	token, err := readToken(cnf, "auth_token")
+	if err != nil {
+		return err
+	}
+	readToken, err := readToken(cnf, "auth_readonly_token")
+	if err != nil {
+		return err
+	}
+	if token != "" && token == readToken {
+		return errors.New("auth_readonly_token error : same as auth_token")
+	}
+	authTokenSum, authReadTokenSum = nil, nil
+	if token != "" {
+		authTokenSum = tokenSum(token)
+	}
+	if readToken != "" {
+		authReadTokenSum = tokenSum(readToken)
+	}
+	return nil
+}
+
+//读取token 配置了 {key}_file 时从文件中读取
+func readToken(cnf *configurator.Config, key string) (string, error) {
+	file, _ := cnf.Get(key + "_file").String()
+	if file == "" {
+		token, _ := cnf.Get(key).String()
+		return token, nil
+	}
+	data, err := ioutil.ReadFile(getAbsPath(file))
+	if err != nil {
+		return "", errors.New(key + "_file error : " + err.Error())
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New(key + "_file error : empty token")
+	}
+	return token, nil
+}
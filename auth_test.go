@@ -0,0 +1,100 @@
+package taskeeper
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//设置测试用的token 返回恢复的方法
+func setTestTokens(token, readToken string) func() {
+	oldToken, oldRead := authTokenSum, authReadTokenSum
+	authTokenSum, authReadTokenSum = tokenSum(token), tokenSum(readToken)
+	return func() {
+		authTokenSum, authReadTokenSum = oldToken, oldRead
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	defer setTestTokens("admin-token", "read-token")()
+
+	p := &peer{addr: "127.0.0.1:1234"}
+	cases := []struct {
+		token  string
+		method string
+		code   int
+	}{
+		{"", MethodStatus, ErrResAuth},
+		{"wrong", MethodStatus, ErrResAuth},
+		{"read-token", MethodStatus, ErrResCodeNo},
+		{"read-token", StatTail, ErrResCodeNo},
+		{"read-token", MethodStop, ErrResDenied},
+		{"read-token", MethodShutdown, ErrResDenied},
+		{"admin-token", MethodShutdown, ErrResCodeNo},
+	}
+	for _, c := range cases {
+		if _, _, code := p.authorize(c.token, c.method, ""); code != c.code {
+			t.Errorf("token %q method %s code %d, want %d", c.token, c.method, code, c.code)
+		}
+	}
+	if _, _, code := localPeer.authorize("", MethodShutdown, ""); code != ErrResCodeNo {
+		t.Errorf("trusted peer code %d", code)
+	}
+}
+
+func TestAuthLegacy(t *testing.T) {
+	defer setTestTokens("admin-token", "read-token")()
+
+	for msg, code := range map[string]string{
+		"stat cmdlist":                      "10|",
+		"auth wrong stat cmdlist":           "10|",
+		"auth read-token ctl reload":        "11|",
+		"auth read-token stat cmd x":        "9|",
+		"auth read-token stat tail x -n 1":  "4|",
+		"auth admin-token ctl act 1 nosuch": "9|",
+	} {
+		server, conn := net.Pipe()
+		go listenHandle(server)
+		conn.Write([]byte(msg))
+		buf := make([]byte, 1024)
+		n, _ := conn.Read(buf)
+		conn.Close()
+		if !strings.HasPrefix(string(buf[:n]), code) {
+			t.Errorf("%s : %q", msg, buf[:n])
+		}
+	}
+}
+
+func TestAuthHTTP(t *testing.T) {
+	defer setTestTokens("admin-token", "read-token")()
+	server := httptest.NewServer(newHTTPHandler())
+	defer server.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{http.MethodGet, "/v1/commands", "", http.StatusUnauthorized},
+		{http.MethodGet, "/v1/commands", "read-token", http.StatusOK},
+		{http.MethodPost, "/v1/commands/nosuch/stop", "read-token", http.StatusForbidden},
+		{http.MethodPost, "/v1/commands/nosuch/stop", "admin-token", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, server.URL+c.path, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		res.Body.Close()
+		if res.StatusCode != c.status {
+			t.Errorf("%s %s token %q status %d, want %d", c.method, c.path, c.token, res.StatusCode, c.status)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package taskeeper
+
+import (
+	"bufio"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//DefaultCgroupMount cgroup v2的挂载位置
+const DefaultCgroupMount = "/sys/fs/cgroup"
+
+//cpu.max的周期 微秒
+const cgroupCPUPeriod = 100000
+
+//keeper自身所在的子cgroup v2中有子cgroup的节点不能直接包含进程
+const cgroupKeeperLeaf = "keeper"
+
+//命令cgroup目录名称的前缀
+const cgroupCmdPrefix = "cmd-"
+
+//需要开启的控制器
+var cgroupControllers = []string{"cpu", "io", "memory", "pids"}
+
+//CgroupConfig 命令的cgroup限制 值为写入对应文件的内容 为空时不修改
+type CgroupConfig struct {
+	MemoryMax string //memory.max
+	CPUMax    string //cpu.max
+	PidsMax   string //pids.max
+	IOWeight  string //io.weight
+}
+
+//CgroupUsage 命令cgroup的资源使用
+type CgroupUsage struct {
+	MemoryCurrent uint64 `json:"memory_current"` //memory.current 包含页缓存
+	CPUUsageUsec  uint64 `json:"cpu_usage_usec"` //cpu.stat中累计的cpu时间
+	PidsCurrent   int    `json:"pids_current"`   //pids.current
+}
+
+var (
+	//cgroupMount cgroup v2的挂载位置
+	cgroupMount = DefaultCgroupMount
+	//cgroupProcSelf 读取keeper所在cgroup的文件
+	cgroupProcSelf = "/proc/self/cgroup"
+	//cgroupRoot 配置的keeper cgroup子树 为空时使用keeper所在的cgroup
+	cgroupRoot string
+
+	//cgroupLock cgroup初始化的锁
+	cgroupLock sync.Mutex
+	//cgroupTried 是否已经尝试初始化
+	cgroupTried bool
+	//cgroupBase keeper的cgroup子树 为空时不使用cgroup
+	cgroupBase string
+)
+
+//读取cgroup的全局配置
+//cgroup_root keeper的cgroup子树 默认使用keeper所在的cgroup
+func loadCgroupConfig(cnf *configurator.Config) {
+	root, _ := cnf.Get("cgroup_root").String()
+	cgroupLock.Lock()
+	defer cgroupLock.Unlock()
+	if root != cgroupRoot {
+		cgroupRoot = root
+		cgroupTried, cgroupBase = false, ""
+	}
+}
+
+//读取命令的cgroup配置 没有配置时返回nil
+//cgroup: {memory_max: "512M", cpu_max: 1.5, pids_max: 100, io_weight: 100}
+func buildCgroup(cnf *configurator.Config) (*CgroupConfig, error) {
+	block := cnf.Get("cgroup")
+	if block.IsNil() {
+		return nil, nil
+	}
+	if runtime.GOOS != "linux" {
+		return nil, errors.New("cgroup error : only supported on linux")
+	}
+	cg := &CgroupConfig{}
+	if v := block.Get("memory_max"); !v.IsNil() {
+		if s, _ := v.String(); s == "max" {
+			cg.MemoryMax = s
+		} else {
+			size, err := getSize(v)
+			if err != nil || size <= 0 {
+				return nil, errors.New("cgroup error : invalid memory_max")
+			}
+			cg.MemoryMax = strconv.FormatInt(size, 10)
+		}
+	}
+	if v := block.Get("cpu_max"); !v.IsNil() {
+		//按核心数配置 1.5 表示每个周期最多使用1.5个核心
+		if s, _ := v.String(); s == "max" {
+			cg.CPUMax = "max " + strconv.Itoa(cgroupCPUPeriod)
+		} else {
+			cores, err := v.Float64()
+			if i, ierr := v.Int(); ierr == nil {
+				cores, err = float64(i), nil
+			}
+			if err != nil || cores <= 0 {
+				return nil, errors.New("cgroup error : invalid cpu_max")
+			}
+			cg.CPUMax = strconv.Itoa(int(cores*cgroupCPUPeriod)) + " " + strconv.Itoa(cgroupCPUPeriod)
+		}
+	}
+	if v := block.Get("pids_max"); !v.IsNil() {
+		if s, _ := v.String(); s == "max" {
+			cg.PidsMax = s
+		} else if n, err := v.Int(); err != nil || n <= 0 {
+			return nil, errors.New("cgroup error : invalid pids_max")
+		} else {
+			cg.PidsMax = strconv.Itoa(n)
+		}
+	}
+	if v := block.Get("io_weight"); !v.IsNil() {
+		n, err := v.Int()
+		if err != nil || n < 1 || n > 10000 {
+			return nil, errors.New("cgroup error : io_weight should be 1-10000")
+		}
+		cg.IOWeight = "default " + strconv.Itoa(n)
+	}
+	return cg, nil
+}
+
+//初始化keeper的cgroup子树 开启需要的控制器
+//使用keeper所在的cgroup时 先将keeper移到子cgroup中
+func setupCgroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return "", errors.New(cgroupMount + " is not a cgroup v2 mount")
+	}
+	self, err := selfCgroup()
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(cgroupMount, self)
+	if cgroupRoot != "" {
+		base = cgroupRoot
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(cgroupMount, base)
+		}
+		if err = os.MkdirAll(base, 0755); err != nil {
+			return "", err
+		}
+	}
+	if base == filepath.Join(cgroupMount, self) {
+		leaf := filepath.Join(base, cgroupKeeperLeaf)
+		if err = os.MkdirAll(leaf, 0755); err != nil {
+			return "", err
+		}
+		if err = writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return "", err
+		}
+	}
+	available, err := ioutil.ReadFile(filepath.Join(base, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	var enable []string
+	for _, name := range strings.Fields(string(available)) {
+		for _, c := range cgroupControllers {
+			if name == c {
+				enable = append(enable, "+"+c)
+			}
+		}
+	}
+	if len(enable) > 0 {
+		if err = writeCgroupFile(base, "cgroup.subtree_control", strings.Join(enable, " ")); err != nil {
+			return "", err
+		}
+	}
+	return base, nil
+}
+
+//keeper所在的cgroup v2路径 读取 `0::/path`
+func selfCgroup() (string, error) {
+	f, err := os.Open(cgroupProcSelf)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "0::") {
+			return line[3:], nil
+		}
+	}
+	return "", errors.New("cgroup v2 path not found in " + cgroupProcSelf)
+}
+
+//准备命令的cgroup 写入配置的限制 返回目录
+//cgroup不可用时返回空 只在第一次失败时打印日志
+func cmdCgroupDir(c *Command) string {
+	if c.cgroup == nil {
+		return ""
+	}
+	cgroupLock.Lock()
+	defer cgroupLock.Unlock()
+	if !cgroupTried {
+		cgroupTried = true
+		base, err := setupCgroup()
+		if err != nil {
+			log.Println("cgroup disabled, commands run without cgroup : " + err.Error())
+		} else {
+			log.Println("cgroup enabled at " + base)
+		}
+		cgroupBase = base
+	}
+	if cgroupBase == "" {
+		return ""
+	}
+	name := c.Name()
+	if name == "" {
+		name = c.ID()
+	}
+	dir := filepath.Join(cgroupBase, cgroupCmdPrefix+cgroupName(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Println("cmd:" + c.ID() + " cgroup create error : " + err.Error())
+		return ""
+	}
+	for file, value := range map[string]string{
+		"memory.max": c.cgroup.MemoryMax,
+		"cpu.max":    c.cgroup.CPUMax,
+		"pids.max":   c.cgroup.PidsMax,
+		"io.weight":  c.cgroup.IOWeight,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := writeCgroupFile(dir, file, value); err != nil {
+			log.Println("cmd:" + c.ID() + " cgroup " + file + " error : " + err.Error())
+		}
+	}
+	return dir
+}
+
+//cgroup目录名称 只保留字母数字和 . _ -
+//名称中有其他字符时替换为_ 并加上原名称的hash后缀 避免 a/b 和 a_b 使用同一个目录
+func cgroupName(name string) string {
+	clean := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	if clean == name {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return clean + "-" + strconv.FormatUint(uint64(h.Sum32()), 16)
+}
+
+//写入cgroup文件 接口文件由内核创建 不存在时返回错误
+func writeCgroupFile(dir, file, value string) error {
+	f, err := os.OpenFile(filepath.Join(dir, file), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//将当前进程加入cgroup
+func joinCgroup(dir string) error {
+	return writeCgroupFile(dir, "cgroup.procs", "0")
+}
+
+//杀死cgroup中的所有进程 优先使用cgroup.kill
+//内核不支持cgroup.kill时 逐个杀死cgroup.procs中的进程
+func killCgroup(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, "cgroup.kill")); err == nil {
+		return writeCgroupFile(dir, "cgroup.kill", "1")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, s := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(s)
+		if err != nil {
+			continue
+		}
+		if p, err := os.FindProcess(pid); err == nil {
+			p.Kill()
+		}
+	}
+	return nil
+}
+
+//读取cgroup的资源使用
+func readCgroupUsage(dir string) *CgroupUsage {
+	u := &CgroupUsage{}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "memory.current")); err == nil {
+		u.MemoryCurrent, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "pids.current")); err == nil {
+		u.PidsCurrent, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "cpu.stat")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "usage_usec" {
+				u.CPUUsageUsec, _ = strconv.ParseUint(fields[1], 10, 64)
+			}
+		}
+	}
+	return u
+}
+
+//删除命令的cgroup 只能删除没有进程的cgroup
+func removeCgroups() {
+	cgroupLock.Lock()
+	defer cgroupLock.Unlock()
+	if cgroupBase == "" {
+		return
+	}
+	dirs, _ := filepath.Glob(filepath.Join(cgroupBase, cgroupCmdPrefix+"*"))
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+}
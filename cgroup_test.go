@@ -0,0 +1,230 @@
+package taskeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+func TestParseCgroup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroup test only on linux")
+	}
+	cg, err := buildCgroup(configurator.BuildConfig(map[string]interface{}{
+		"cgroup": map[interface{}]interface{}{
+			"memory_max": "512M",
+			"cpu_max":    1.5,
+			"pids_max":   100,
+			"io_weight":  200,
+		},
+	}))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := CgroupConfig{MemoryMax: "536870912", CPUMax: "150000 100000", PidsMax: "100", IOWeight: "default 200"}
+	if *cg != want {
+		t.Errorf("cgroup %+v, want %+v", *cg, want)
+	}
+	if cg, _ := buildCgroup(configurator.BuildConfig(map[string]interface{}{})); cg != nil {
+		t.Error("cgroup without config should be nil")
+	}
+
+	for _, bad := range []map[interface{}]interface{}{
+		{"memory_max": "lots"},
+		{"cpu_max": 0},
+		{"pids_max": -1},
+		{"io_weight": 20000},
+	} {
+		if _, err := buildCgroup(configurator.BuildConfig(map[string]interface{}{"cgroup": bad})); err == nil {
+			t.Errorf("cgroup %v should fail", bad)
+		}
+	}
+}
+
+//使用临时目录模拟cgroupfs
+func fakeCgroupfs(t *testing.T, controllers bool) (string, func()) {
+	dir, err := ioutil.TempDir("", "taskeeper-cgroup")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	self := filepath.Join(dir, "proc-self-cgroup")
+	ioutil.WriteFile(self, []byte("0::/svc\n"), 0644)
+	mount := filepath.Join(dir, "fs")
+	os.MkdirAll(filepath.Join(mount, "svc"), 0755)
+	if controllers {
+		ioutil.WriteFile(filepath.Join(mount, "cgroup.controllers"), []byte("cpuset cpu io memory pids\n"), 0644)
+		ioutil.WriteFile(filepath.Join(mount, "svc", "cgroup.controllers"), []byte("cpu memory pids hugetlb\n"), 0644)
+		fakeCgroupDir(t, filepath.Join(mount, "svc"), "cgroup.subtree_control")
+		fakeCgroupDir(t, filepath.Join(mount, "svc", cgroupKeeperLeaf), "cgroup.procs")
+	}
+
+	oldMount, oldSelf, oldRoot := cgroupMount, cgroupProcSelf, cgroupRoot
+	cgroupMount, cgroupProcSelf, cgroupRoot = mount, self, ""
+	cgroupTried, cgroupBase = false, ""
+	return mount, func() {
+		cgroupMount, cgroupProcSelf, cgroupRoot = oldMount, oldSelf, oldRoot
+		cgroupTried, cgroupBase = false, ""
+		os.RemoveAll(dir)
+	}
+}
+
+//模拟内核创建cgroup目录和其中的接口文件
+func fakeCgroupDir(t *testing.T, dir string, files ...string) string {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, file := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), nil, 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	return dir
+}
+
+func TestCgroupName(t *testing.T) {
+	if name := cgroupName("web-api_1.0"); name != "web-api_1.0" {
+		t.Errorf("cgroup name %q", name)
+	}
+	//替换字符后的名称不能与其他命令重复
+	if a, b := cgroupName("a/b"), cgroupName("a_b"); a == b || !strings.HasPrefix(a, "a_b-") {
+		t.Errorf("cgroup names %q %q", a, b)
+	}
+	if cgroupName("a/b") != cgroupName("a/b") || cgroupName("a/b") == cgroupName("a b") {
+		t.Error("cgroup name suffix not stable")
+	}
+}
+
+func TestCgroupSetup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroup test only on linux")
+	}
+	mount, cleanup := fakeCgroupfs(t, true)
+	defer cleanup()
+
+	c := NewCommand("/bin/true", nil, "")
+	c.SetID("cgsetup")
+	c.SetName("web/api")
+	c.SetCgroup(&CgroupConfig{MemoryMax: "1048576", PidsMax: "10"})
+	want := fakeCgroupDir(t, filepath.Join(mount, "svc", cgroupCmdPrefix+cgroupName("web/api")), "memory.max", "pids.max")
+	dir := cmdCgroupDir(c)
+	if dir != want {
+		t.Fatalf("cgroup dir %q", dir)
+	}
+
+	read := func(path ...string) string {
+		data, _ := ioutil.ReadFile(filepath.Join(path...))
+		return string(data)
+	}
+	//keeper移到子cgroup中 开启可用的控制器
+	if pid := read(mount, "svc", cgroupKeeperLeaf, "cgroup.procs"); pid != strconv.Itoa(os.Getpid()) {
+		t.Errorf("keeper leaf procs %q", pid)
+	}
+	if ctl := read(mount, "svc", "cgroup.subtree_control"); ctl != "+cpu +memory +pids" {
+		t.Errorf("subtree_control %q", ctl)
+	}
+	if read(dir, "memory.max") != "1048576" || read(dir, "pids.max") != "10" {
+		t.Errorf("limits memory.max %q pids.max %q", read(dir, "memory.max"), read(dir, "pids.max"))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cpu.max")); err == nil {
+		t.Error("unset cpu.max written")
+	}
+
+	//读取资源使用
+	ioutil.WriteFile(filepath.Join(dir, "memory.current"), []byte("4096\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "pids.current"), []byte("3\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "cpu.stat"), []byte("usage_usec 2500000\nuser_usec 2000000\n"), 0644)
+	if u := readCgroupUsage(dir); *u != (CgroupUsage{MemoryCurrent: 4096, CPUUsageUsec: 2500000, PidsCurrent: 3}) {
+		t.Errorf("usage %+v", *u)
+	}
+
+	//支持cgroup.kill时写入1
+	ioutil.WriteFile(filepath.Join(dir, "cgroup.kill"), nil, 0644)
+	if err := killCgroup(dir); err != nil || read(dir, "cgroup.kill") != "1" {
+		t.Errorf("cgroup.kill %q %v", read(dir, "cgroup.kill"), err)
+	}
+	os.Remove(filepath.Join(dir, "cgroup.kill"))
+
+	//不支持cgroup.kill时逐个杀死进程
+	p := NewCommand("/bin/sleep", []string{"30"}, "")
+	if p.Start() <= 0 {
+		t.Fatal("start failed")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(p.Pid())+"\n"), 0644)
+	if err := killCgroup(dir); err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		p.Kill()
+		t.Fatal("process in cgroup.procs not killed")
+	}
+}
+
+func TestCgroupStart(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroup test only on linux")
+	}
+	mount, cleanup := fakeCgroupfs(t, true)
+	defer cleanup()
+
+	//子进程写入cgroup.procs后执行命令
+	c := NewCommand("/bin/true", nil, "")
+	c.SetID("cgstart")
+	c.SetCgroup(&CgroupConfig{})
+	fakeCgroupDir(t, filepath.Join(mount, "svc", "cmd-cgstart"), "cgroup.procs")
+	if c.Start() <= 0 {
+		t.Fatal("start failed")
+	}
+	if state, err := c.Wait(); err != nil || state.ExitCode() != 0 {
+		t.Fatalf("wait %v %v", state, err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(mount, "svc", "cmd-cgstart", "cgroup.procs"))
+	if string(data) != "0" {
+		t.Errorf("child cgroup.procs %q", data)
+	}
+}
+
+func TestCgroupDegrade(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroup test only on linux")
+	}
+	mount, cleanup := fakeCgroupfs(t, false)
+	defer cleanup()
+
+	c := NewCommand("/bin/true", nil, "")
+	c.SetID("cgdegrade")
+	c.SetCgroup(&CgroupConfig{PidsMax: "10"})
+	if dir := cmdCgroupDir(c); dir != "" {
+		t.Errorf("cgroup dir %q without cgroup v2", dir)
+	}
+	if !cgroupTried || cgroupBase != "" {
+		t.Error("cgroup should be disabled")
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(mount, "svc")); len(entries) != 0 {
+		t.Errorf("cgroupfs modified : %d entries", len(entries))
+	}
+
+	//没有cgroup时正常启动
+	if c.Start() <= 0 {
+		t.Fatal("start failed")
+	}
+	if state, err := c.Wait(); err != nil || state.ExitCode() != 0 {
+		t.Fatalf("wait %v %v", state, err)
+	}
+	if c.currentCgroup() != "" {
+		t.Errorf("cgroup dir %q", c.currentCgroup())
+	}
+}
@@ -0,0 +1,52 @@
+package taskeeper
+
+import (
+	"os"
+	"sync"
+)
+
+//配置了资源限制或cgroup的命令先以keeper自身启动 完成设置后再执行命令
+//子进程的第一个参数为标记 设置通过环境变量传递给子进程
+const (
+	childExecArg = "taskeeper-child-exec" //子进程的标记 作为子进程的argv[0] 之后为命令和参数
+	rlimitEnv    = "TASKEEPER_RLIMITS"    //资源限制 `nofile=1024:4096,core=0:0`
+	cgroupEnv    = "TASKEEPER_CGROUP"     //加入的cgroup目录
+)
+
+var (
+	//keeper自身的可执行文件
+	selfExe     string
+	selfExeErr  error
+	selfExeOnce sync.Once
+)
+
+//ExecChild keeper启动的子进程完成设置后执行命令 不会返回
+//只在argv[0]为子进程标记时生效 其他情况直接返回 需要在main的开始调用
+func ExecChild() {
+	if len(os.Args) < 2 || os.Args[0] != childExecArg {
+		return
+	}
+	childExec(os.Getenv(rlimitEnv), os.Getenv(cgroupEnv), os.Args[1:])
+}
+
+//启动命令使用的可执行文件 参数和环境变量
+//需要在执行命令之前完成设置时先启动keeper自身 参数前加上子进程标记 环境变量为nil时继承keeper的环境变量
+func (c *Command) execPath(cgroupDir string, args []string) (string, []string, []string, error) {
+	var env []string
+	if len(c.limits) > 0 {
+		env = append(env, rlimitEnv+"="+encodeLimits(c.limits))
+	}
+	if cgroupDir != "" {
+		env = append(env, cgroupEnv+"="+cgroupDir)
+	}
+	if len(env) == 0 {
+		return c.cmd, args, nil, nil
+	}
+	selfExeOnce.Do(func() {
+		selfExe, selfExeErr = os.Executable()
+	})
+	if selfExeErr != nil {
+		return "", nil, nil, selfExeErr
+	}
+	return selfExe, append([]string{childExecArg}, args...), append(os.Environ(), env...), nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package taskeeper
+
+import "os"
+
+//其他系统不支持资源限制和cgroup 不会以子进程启动
+func childExec(limits, cgroup string, args []string) {
+	os.Stderr.WriteString("taskeeper start command failed : child exec not supported\n")
+	os.Exit(127)
+}
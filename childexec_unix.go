@@ -0,0 +1,30 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package taskeeper
+
+import (
+	"os"
+	"syscall"
+)
+
+//加入cgroup 设置资源限制后替换为命令进程 pid不变
+//无法加入cgroup时只打印警告 资源限制设置或执行失败时以127退出
+func childExec(limits, cgroup string, args []string) {
+	os.Unsetenv(rlimitEnv)
+	os.Unsetenv(cgroupEnv)
+	if cgroup != "" {
+		if err := joinCgroup(cgroup); err != nil {
+			os.Stderr.WriteString("taskeeper join cgroup failed : " + err.Error() + "\n")
+		}
+	}
+	var err error
+	if limits != "" {
+		err = setChildLimits(limits)
+	}
+	if err == nil {
+		err = syscall.Exec(args[0], args, os.Environ())
+	}
+	os.Stderr.WriteString("taskeeper start command failed : " + err.Error() + "\n")
+	os.Exit(127)
+}
@@ -0,0 +1,209 @@
+//Package client keeper控制接口的客户端
+//使用一行json的请求和响应与keeper通信 协议见 taskeeper.ProtocolVersion
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+
+	tk "github.com/kasiss-liu/taskeeper"
+)
+
+//Client keeper控制接口的客户端 每次请求使用一个新的连接
+type Client struct {
+	network   string
+	addr      string
+	token     string
+	tlsConfig *tls.Config
+	lastID    uint64
+}
+
+//New 创建一个客户端 network为tcp或unix
+func New(network, addr string) *Client {
+	return &Client{network: network, addr: addr}
+}
+
+//SetToken 设置请求携带的token
+func (c *Client) SetToken(token string) *Client {
+	c.token = token
+	return c
+}
+
+//SetTLS 设置tcp连接使用的tls配置
+func (c *Client) SetTLS(conf *tls.Config) *Client {
+	c.tlsConfig = conf
+	return c
+}
+
+//Network 客户端连接的网络类型 tcp或unix
+func (c *Client) Network() string {
+	return c.network
+}
+
+//Addr 客户端连接的地址
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+//Call 发送一个请求 将结果解析到result中 result为nil时忽略结果
+//keeper返回的错误为 *taskeeper.ResponseError
+func (c *Client) Call(ctx context.Context, method string, params tk.RequestParams, result interface{}) error {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := closeOnDone(ctx, conn)
+	defer close(done)
+
+	resp, _, err := c.roundTrip(ctx, conn, method, params)
+	if err != nil {
+		return err
+	}
+	if result == nil || len(resp.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+//Subscribe 订阅keeper的事件 每个事件调用一次handle 直到context取消或连接断开
+//name或group不为空时只接收对应命令的事件 keeper断开连接时返回io.EOF
+func (c *Client) Subscribe(ctx context.Context, name, group string, handle func(e *tk.Event)) error {
+	conn, err := c.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := closeOnDone(ctx, conn)
+	defer close(done)
+
+	_, reader, err := c.roundTrip(ctx, conn, tk.MethodSubscribe, tk.RequestParams{Name: name, Group: group})
+	if err != nil {
+		return err
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return ctxErr(ctx, err)
+		}
+		e := &tk.Event{}
+		if err = json.Unmarshal(line, e); err != nil {
+			return err
+		}
+		handle(e)
+	}
+}
+
+//发送一个请求并读取响应 返回连接的reader用于读取后续的内容
+func (c *Client) roundTrip(ctx context.Context, conn net.Conn, method string, params tk.RequestParams) (*tk.Response, *bufio.Reader, error) {
+	req := tk.Request{
+		V:      tk.ProtocolVersion,
+		ID:     atomic.AddUint64(&c.lastID, 1),
+		Method: method,
+		Params: params,
+		Token:  c.token,
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = conn.Write(append(data, '\n')); err != nil {
+		return nil, nil, ctxErr(ctx, err)
+	}
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return nil, nil, ctxErr(ctx, err)
+	}
+	resp := &tk.Response{}
+	if err = json.Unmarshal(line, resp); err != nil {
+		return nil, nil, err
+	}
+	if resp.ID != req.ID {
+		return nil, nil, errors.New("response id mismatch")
+	}
+	if resp.Error != nil {
+		return nil, nil, resp.Error
+	}
+	return resp, reader, nil
+}
+
+//context取消时关闭连接 结束阻塞的读写 关闭返回的通道后停止等待
+func closeOnDone(ctx context.Context, conn net.Conn) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return done
+}
+
+//Dial 连接keeper 设置了tls时完成握手 context的截止时间作为连接的截止时间
+func (c *Client) Dial(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c.tlsConfig == nil || c.network != "tcp" {
+		return conn, nil
+	}
+	conf := c.tlsConfig.Clone()
+	if conf.ServerName == "" {
+		if host, _, err := net.SplitHostPort(c.addr); err == nil {
+			conf.ServerName = host
+		}
+	}
+	tc := tls.Client(conn, conf)
+	if err = tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, ctxErr(ctx, err)
+	}
+	return tc, nil
+}
+
+//LoadTLSConfig 读取证书创建tls配置
+//caFile 校验keeper证书的CA 为空时使用系统CA certFile keyFile 客户端证书 为空时不使用
+func LoadTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		conf.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	return conf, nil
+}
+
+//context结束导致的错误 返回context的错误
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
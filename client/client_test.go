@@ -0,0 +1,153 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	tk "github.com/kasiss-liu/taskeeper"
+)
+
+const testConfig = `
+log: "%DIR%/keeper.log"
+socket_mode: "0660"
+cmds:
+ -
+  name: sleeper
+  cmd: "/bin/sh"
+  args: ["-c", "sleep 30"]
+  output: "/dev/null"
+`
+
+//在当前进程中启动一个keeper
+func startKeeper(t *testing.T, dir string) chan struct{} {
+	conf := filepath.Join(dir, "config.yml")
+	data := strings.Replace(testConfig, "%DIR%", dir, 1)
+	if err := ioutil.WriteFile(conf, []byte(data), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !tk.SetRunDir(dir) {
+		t.Fatal("set run dir failed")
+	}
+	done := make(chan struct{})
+	go func() {
+		tk.Start(conf, false, false)
+		close(done)
+	}()
+	return done
+}
+
+//等待条件成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 50; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for " + what)
+}
+
+func TestClient(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("need /bin/sh")
+	}
+	dir, err := ioutil.TempDir("", "taskeeper-client")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	done := startKeeper(t, dir)
+
+	var c *Client
+	waitFor(t, "pid desc", func() bool {
+		c, err = Discover()
+		return err == nil
+	})
+	//没有配置host和port时只启动unix socket
+	if c.Network() != "unix" {
+		t.Fatalf("discover %s %s", c.Network(), c.Addr())
+	}
+	if info, err := os.Stat(c.Addr()); err != nil || info.Mode().Perm() != 0660 {
+		t.Fatalf("socket file %v %v", info, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	waitFor(t, "status", func() bool {
+		_, err = c.Status(ctx)
+		return err == nil
+	})
+	list, err := c.ListCommands(ctx)
+	if err != nil || len(list) != 1 || list[0].Name != "sleeper" {
+		t.Fatalf("commands %+v %v", list, err)
+	}
+
+	//订阅命令的事件 启动后收到start事件
+	events := make(chan *tk.Event, 16)
+	subCtx, cancelSub := context.WithCancel(context.Background())
+	subDone := make(chan error, 1)
+	go func() {
+		subDone <- c.Subscribe(subCtx, "sleeper", "", func(e *tk.Event) {
+			events <- e
+		})
+	}()
+	waitFor(t, "subscribe", func() bool {
+		status, err := c.Status(ctx)
+		return err == nil && status.Subscribers > 0
+	})
+
+	if err = c.Start(ctx, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case e := <-events:
+		if e.Type != tk.EventStart || e.Name != "sleeper" || e.Pid == 0 {
+			t.Errorf("start event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("start event not received")
+	}
+	cancelSub()
+	if err = <-subDone; err != context.Canceled {
+		t.Errorf("subscribe error %v", err)
+	}
+	waitFor(t, "cmd start", func() bool {
+		cmd, err := c.Command(ctx, "sleeper")
+		return err == nil && cmd.Pid > 0
+	})
+	status, err := c.Status(ctx)
+	if err != nil || status.Pid != os.Getpid() || status.TotalTasks != 1 {
+		t.Fatalf("status %+v %v", status, err)
+	}
+
+	_, err = c.Command(ctx, "nosuch")
+	if e, ok := err.(*tk.ResponseError); !ok || e.Code != tk.ErrResNoCmd {
+		t.Fatalf("missing cmd error %v", err)
+	}
+	if err = c.Stop(ctx, ""); err == nil {
+		t.Fatal("stop without name should fail")
+	}
+
+	//超时的context
+	expired, cancelExpired := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancelExpired()
+	time.Sleep(time.Millisecond)
+	if _, err = c.Status(expired); err != context.DeadlineExceeded {
+		t.Fatalf("expired context error %v", err)
+	}
+
+	if err = c.Shutdown(ctx); err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("keeper did not exit")
+	}
+}
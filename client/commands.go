@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	tk "github.com/kasiss-liu/taskeeper"
+)
+
+//Discover 从keeper的pid描述文件中获取地址 创建客户端
+//优先使用unix socket 没有socket文件时使用tcp地址
+func Discover() (*Client, error) {
+	desc, err := tk.ParsePidDesc()
+	if err != nil {
+		return nil, err
+	}
+	if desc.SockFile != "" {
+		if _, err := os.Stat(desc.SockFile); err == nil {
+			return New("unix", desc.SockFile), nil
+		}
+	}
+	if desc.TCPAddr == "" {
+		return nil, errors.New("keeper address not found in pid desc")
+	}
+	return New("tcp", desc.TCPAddr), nil
+}
+
+//Status keeper的运行状态
+func (c *Client) Status(ctx context.Context) (tk.RunningStatus, error) {
+	var status tk.RunningStatus
+	err := c.Call(ctx, tk.MethodStatus, tk.RequestParams{}, &status)
+	return status, err
+}
+
+//ListCommands 所有命令的状态
+func (c *Client) ListCommands(ctx context.Context) ([]tk.CmdStatus, error) {
+	var list []tk.CmdStatus
+	err := c.Call(ctx, tk.MethodCommands, tk.RequestParams{}, &list)
+	return list, err
+}
+
+//Command 按名称或id查询单个命令的状态
+func (c *Client) Command(ctx context.Context, name string) (tk.CmdStatus, error) {
+	var status tk.CmdStatus
+	err := c.Call(ctx, tk.MethodCommand, tk.RequestParams{Name: name}, &status)
+	return status, err
+}
+
+//Output 命令内存缓存中最近的输出
+func (c *Client) Output(ctx context.Context, name string) (string, error) {
+	var output string
+	err := c.Call(ctx, tk.MethodOutput, tk.RequestParams{Name: name}, &output)
+	return output, err
+}
+
+//Config keeper的配置
+func (c *Client) Config(ctx context.Context) (tk.ProcessConfig, error) {
+	var conf tk.ProcessConfig
+	err := c.Call(ctx, tk.MethodConfig, tk.RequestParams{}, &conf)
+	return conf, err
+}
+
+//Audit 最近的审计记录 lines不大于0时返回默认条数
+func (c *Client) Audit(ctx context.Context, lines int) ([]tk.AuditEntry, error) {
+	var list []tk.AuditEntry
+	err := c.Call(ctx, tk.MethodAudit, tk.RequestParams{Lines: lines}, &list)
+	return list, err
+}
+
+//Start 启动命令 name为空时启动所有命令
+func (c *Client) Start(ctx context.Context, name string) error {
+	return c.Call(ctx, tk.MethodStart, tk.RequestParams{Name: name}, nil)
+}
+
+//Stop 停止命令
+func (c *Client) Stop(ctx context.Context, name string) error {
+	return c.Call(ctx, tk.MethodStop, tk.RequestParams{Name: name}, nil)
+}
+
+//Restart 重启命令
+func (c *Client) Restart(ctx context.Context, name string) error {
+	return c.Call(ctx, tk.MethodRestart, tk.RequestParams{Name: name}, nil)
+}
+
+//Pause 暂停命令 name为空时暂停所有命令
+func (c *Client) Pause(ctx context.Context, name string) error {
+	return c.Call(ctx, tk.MethodPause, tk.RequestParams{Name: name}, nil)
+}
+
+//Exec 单次执行命令
+func (c *Client) Exec(ctx context.Context, name string) error {
+	return c.Call(ctx, tk.MethodExec, tk.RequestParams{Name: name}, nil)
+}
+
+//Reload 重新加载配置并重启所有命令
+func (c *Client) Reload(ctx context.Context) error {
+	return c.Call(ctx, tk.MethodReload, tk.RequestParams{}, nil)
+}
+
+//Shutdown 停止所有命令后keeper退出
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.Call(ctx, tk.MethodShutdown, tk.RequestParams{}, nil)
+}
@@ -1,23 +1,98 @@
 package taskeeper
 
 import (
+	"errors"
 	"log"
 	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
+const (
+	//DefaultStopWait 发送停止信号后 等待进程退出的默认时间
+	DefaultStopWait = 5 * time.Second
+	//runHistorySize 每个命令保留的运行记录条数
+	runHistorySize = 10
+	//pipeDrainWait 进程退出后等待输出管道写完的时间
+	pipeDrainWait = time.Second
+)
+
+//运行记录的结果类型
+const (
+	RunResultSuccess = "success" //正常结束
+	RunResultFailed  = "failed"  //启动失败或非0退出
+	RunResultTimeout = "timeout" //执行超时被终止
+)
+
+//cron错过执行时间后的补偿策略
+const (
+	CatchUpNone   = "none"   //不补偿
+	CatchUpLatest = "latest" //只补偿最近的一次
+	CatchUpAll    = "all"    //依次补偿所有错过的执行
+)
+
+//StderrToStdout 错误输出与标准输出合并
+const StderrToStdout = "stdout"
+
+//RunRecord 单次执行的运行记录
+type RunRecord struct {
+	StartTime string `json:"start_time"` //开始时间
+	EndTime   string `json:"end_time"`   //结束时间
+	Duration  string `json:"duration"`   //执行时长
+	ExitCode  int    `json:"exit_code"`  //退出码 被信号终止时为-1
+	Result    string `json:"result"`     //运行结果 success|failed|timeout
+}
+
 //Command 执行命令的配置结构
 //重新封装了cmd
 type Command struct {
 	id          string      //为每个命令随机分配一个字符串id
 	name        string      //为命令指定一个名称
+	group       string      //命令所属的分组
 	pid         int         //命令如果运行 会将运行时的pid保存
 	cmd         string      //命令的位置
 	args        []string    //命令启动时的参数
-	output      string      //命令执行时打印输出位置
+	output      string      //命令执行时打印输出位置 stdout和stderr共用
+	stdout      string      //标准输出的打印位置 为空时使用output
+	stderr      string      //错误输出的打印位置 为空时使用output stdout表示与标准输出合并
 	isCron      bool        //是否时定时任务
 	cronExpress string      //定时任务表达式
 	process     *os.Process //具体进程指针
 	isPause     bool        //是否暂停使用
+
+	timeout    time.Duration  //单次执行的超时时间 0为不限制
+	stopSignal os.Signal      //停止进程时发送的信号
+	stopWait   time.Duration  //发送停止信号后等待进程退出的时间
+	exited     chan struct{}  //进程退出后关闭的通道
+	procLock   sync.RWMutex   //pid 进程指针 退出通道和cgroup目录的读写锁
+	pipes      sync.WaitGroup //正在复制的输出管道
+
+	runLock sync.Mutex  //运行记录的锁
+	runs    []RunRecord //最近的运行记录
+
+	catchUp          string        //cron错过执行后的补偿策略
+	startingDeadline time.Duration //只补偿该时间窗口内错过的执行
+
+	rotate RotateConfig //输出文件的切割配置 开启后输出经过keeper的管道写入
+
+	linePrefix string //按行处理输出时每行的前缀模板 为空时不按行处理
+	timeFormat string //前缀中 {time} 的时间格式
+
+	outputRing *ringBuffer //最近输出的内存缓存 为nil时不缓存
+
+	limits map[string]Rlimit //子进程的资源限制
+
+	maxMemory    uint64        //常驻内存上限 0为不限制
+	maxCPU       float64       //cpu使用率上限 0为不限制
+	watchSustain time.Duration //超限持续该时间后重启
+	watchdogStop int32         //进程正在被资源上限检查停止
+
+	cgroup    *CgroupConfig //cgroup限制 为nil时不使用cgroup
+	cgroupDir string        //最近一次启动时加入的cgroup目录
+
+	hooks map[string][]*Hook //命令的钩子 按钩子名称保存
 }
 
 //SetCron 设置命令为cron命令
@@ -38,6 +113,34 @@ func (c *Command) Name() string {
 	return c.name
 }
 
+//SetGroup 设置命令的分组
+func (c *Command) SetGroup(group string) *Command {
+	c.group = group
+	return c
+}
+
+//Group 获取命令的分组
+func (c *Command) Group() string {
+	return c.group
+}
+
+//SetLimits 设置子进程的资源限制 启动时在执行命令之前生效
+func (c *Command) SetLimits(limits map[string]Rlimit) *Command {
+	c.limits = limits
+	return c
+}
+
+//Limits 获取配置的资源限制
+func (c *Command) Limits() map[string]Rlimit {
+	return c.limits
+}
+
+//SetCgroup 设置命令的cgroup限制 启动时在执行命令之前加入cgroup
+func (c *Command) SetCgroup(cg *CgroupConfig) *Command {
+	c.cgroup = cg
+	return c
+}
+
 //IsCron 验证是否是cron命令
 func (c *Command) IsCron() bool {
 	return c.isCron
@@ -48,6 +151,39 @@ func (c *Command) Output() string {
 	return c.output
 }
 
+//SetStdout 设置标准输出的打印位置
+func (c *Command) SetStdout(stdout string) *Command {
+	c.stdout = stdout
+	return c
+}
+
+//SetStderr 设置错误输出的打印位置 stdout表示与标准输出合并
+func (c *Command) SetStderr(stderr string) *Command {
+	c.stderr = stderr
+	return c
+}
+
+//Stdout 获取标准输出的打印位置
+func (c *Command) Stdout() string {
+	if c.stdout != "" {
+		return c.stdout
+	}
+	return c.output
+}
+
+//Stderr 获取错误输出的打印位置
+func (c *Command) Stderr() string {
+	switch {
+	case c.stderr == StderrToStdout:
+		return c.Stdout()
+	case c.stderr != "":
+		return c.stderr
+	case c.output != "":
+		return c.output
+	}
+	return c.Stdout()
+}
+
 //TurnOffCron 主动关闭cron
 func (c *Command) TurnOffCron() bool {
 	c.isCron = false
@@ -63,17 +199,62 @@ func (c *Command) TurnOnCron() bool {
 //Start 命令启动
 func (c *Command) Start() int {
 	var err error
-	var file *os.File
 
 	args := append([]string{c.cmd}, c.args...)
-	file, _ = os.OpenFile(c.output, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0755)
-	if file == nil {
-		file = os.Stdout
+	var pipes []outputPipe
+	stdout, pipe := c.openOutput(c.Stdout(), streamStdout)
+	if pipe != nil {
+		pipes = append(pipes, *pipe)
+	}
+	//输出位置相同时 共用同一个文件 按行处理或者输出到syslog时需要区分来源 分别使用管道
+	stderr := stdout
+	if c.Stderr() != c.Stdout() || c.linePrefix != "" || isSyslogPath(c.Stdout()) {
+		stderr, pipe = c.openOutput(c.Stderr(), streamStderr)
+		if pipe != nil {
+			pipes = append(pipes, *pipe)
+		}
+	}
+	cgroupDir := cmdCgroupDir(c)
+	path, args, env, err := c.execPath(cgroupDir, args)
+	var process *os.Process
+	if err == nil {
+		process, err = os.StartProcess(path, args, &os.ProcAttr{Env: env, Files: []*os.File{nil, stdout, stderr}})
 	}
-	c.process, err = os.StartProcess(c.cmd, args, &os.ProcAttr{Files: []*os.File{nil, file, file}})
+	//子进程已经持有文件 父进程关闭自己的副本 共用的文件只关闭一次
+	closed := map[*os.File]bool{os.Stdout: true}
+	for _, file := range []*os.File{stdout, stderr} {
+		if !closed[file] {
+			closed[file] = true
+			file.Close()
+		}
+	}
+	c.procLock.Lock()
+	c.cgroupDir = cgroupDir
 	if err == nil {
-		c.pid = c.process.Pid
-		return c.pid
+		c.process = process
+		c.pid = process.Pid
+		c.exited = make(chan struct{})
+	}
+	c.procLock.Unlock()
+	for _, p := range pipes {
+		if err == nil {
+			if p.lines {
+				p.prefix = c.prefixFunc(p.stream)
+			}
+			if p.syslog != nil {
+				p.syslog.procID = strconv.Itoa(process.Pid)
+			}
+			c.pipes.Add(1)
+			go func(p outputPipe) {
+				defer c.pipes.Done()
+				p.copy()
+			}(p)
+		} else {
+			p.reader.Close()
+		}
+	}
+	if err == nil {
+		return process.Pid
 	}
 
 	log.Println(c.cmd + " start failed : " + err.Error())
@@ -92,25 +273,57 @@ func (c *Command) SetID(id string) {
 
 //Pid 获取pid
 func (c *Command) Pid() int {
+	c.procLock.RLock()
+	defer c.procLock.RUnlock()
 	return c.pid
 }
 
 //ResetPid 重置命令pid 用于程序退出后标记
 func (c *Command) ResetPid() {
-	c.pid = 0
+	c.setPid(0)
+}
+
+//设置命令pid
+func (c *Command) setPid(pid int) {
+	c.procLock.Lock()
+	c.pid = pid
+	c.procLock.Unlock()
 }
 
 //Process 获取进程结构指针
 func (c *Command) Process() *os.Process {
+	c.procLock.RLock()
+	defer c.procLock.RUnlock()
 	return c.process
 }
 
+//最近一次启动时的进程 退出通道和cgroup目录
+func (c *Command) running() (*os.Process, chan struct{}, string) {
+	c.procLock.RLock()
+	defer c.procLock.RUnlock()
+	return c.process, c.exited, c.cgroupDir
+}
+
+//获取最近一次启动时加入的cgroup目录
+func (c *Command) currentCgroup() string {
+	c.procLock.RLock()
+	defer c.procLock.RUnlock()
+	return c.cgroupDir
+}
+
 //Kill 杀死进程
+//使用cgroup时杀死cgroup中的整个进程树
 func (c *Command) Kill() error {
-	if c.process != nil {
-		return c.process.Kill()
+	process, _, cgroupDir := c.running()
+	if cgroupDir != "" {
+		if err := killCgroup(cgroupDir); err == nil {
+			return nil
+		}
+	}
+	if process != nil {
+		return process.Kill()
 	}
-	process, err := os.FindProcess(c.pid)
+	process, err := os.FindProcess(c.Pid())
 	if err != nil {
 		return err
 	}
@@ -125,18 +338,60 @@ func (c *Command) Wait() (*os.ProcessState, error) {
 			log.Println(c.cmd + " wait() panic")
 		}
 	}()
-	return c.process.Wait()
+	process, exited, _ := c.running()
+	state, err := process.Wait()
+	if exited != nil {
+		close(exited)
+	}
+	c.waitPipes()
+	return state, err
+}
+
+//等待输出管道中剩余的内容写完
+//子进程的后代进程可能继续持有管道 最多等待pipeDrainWait
+func (c *Command) waitPipes() {
+	drained := make(chan struct{})
+	go func() {
+		c.pipes.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(pipeDrainWait):
+	}
+}
+
+//Stop 优雅停止进程
+//先发送配置的停止信号 超过等待时间进程仍未退出则强制杀死
+func (c *Command) Stop() error {
+	process, exited, _ := c.running()
+	if process == nil {
+		return errors.New("process not running")
+	}
+	if err := c.Singal(c.StopSignal()); err != nil {
+		return c.Kill()
+	}
+	if exited == nil {
+		return nil
+	}
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(c.StopWait()):
+		log.Println("cmd:" + c.ID() + " not exit after " + c.StopWait().String() + ", kill it")
+		return c.Kill()
+	}
 }
 
 //Singal 向进程传递信号
 func (c *Command) Singal(sig os.Signal) error {
-	return c.process.Signal(sig)
+	return c.Process().Signal(sig)
 }
 
 //Release 释放进程资源
 //释放以后 不能对进程进行任何操作
 func (c *Command) Release() error {
-	return c.process.Release()
+	return c.Process().Release()
 }
 
 //SetPause 设置命令暂停运行
@@ -154,6 +409,102 @@ func (c *Command) IsPause() bool {
 	return c.isPause
 }
 
+//SetTimeout 设置单次执行的超时时间
+func (c *Command) SetTimeout(d time.Duration) *Command {
+	c.timeout = d
+	return c
+}
+
+//Timeout 获取单次执行的超时时间
+func (c *Command) Timeout() time.Duration {
+	return c.timeout
+}
+
+//SetStopSignal 设置停止进程时发送的信号及等待时间
+func (c *Command) SetStopSignal(sig os.Signal, wait time.Duration) *Command {
+	c.stopSignal = sig
+	c.stopWait = wait
+	return c
+}
+
+//StopSignal 获取停止进程时发送的信号 默认SIGTERM
+func (c *Command) StopSignal() os.Signal {
+	if c.stopSignal == nil {
+		return syscall.SIGTERM
+	}
+	return c.stopSignal
+}
+
+//StopWait 获取发送停止信号后等待进程退出的时间
+func (c *Command) StopWait() time.Duration {
+	if c.stopWait <= 0 {
+		return DefaultStopWait
+	}
+	return c.stopWait
+}
+
+//SetRotate 设置输出文件的切割配置
+func (c *Command) SetRotate(rc RotateConfig) *Command {
+	c.rotate = rc
+	return c
+}
+
+//SetLinePrefix 设置按行处理输出时的前缀模板以及时间格式
+//模板支持 {time} {name} {id} {stream} {pid}
+func (c *Command) SetLinePrefix(prefix, timeFormat string) *Command {
+	c.linePrefix = prefix
+	c.timeFormat = timeFormat
+	return c
+}
+
+//SetOutputBuffer 设置最近输出的内存缓存大小 0为不缓存
+func (c *Command) SetOutputBuffer(size int) *Command {
+	c.outputRing = newRingBuffer(size)
+	return c
+}
+
+//RecentOutput 获取内存缓存中最近的输出
+func (c *Command) RecentOutput() []byte {
+	if c.outputRing == nil {
+		return nil
+	}
+	return c.outputRing.Bytes()
+}
+
+//SetCatchUp 设置cron错过执行后的补偿策略以及补偿的时间窗口
+func (c *Command) SetCatchUp(policy string, deadline time.Duration) *Command {
+	c.catchUp = policy
+	c.startingDeadline = deadline
+	return c
+}
+
+//CatchUp 获取cron错过执行后的补偿策略 默认不补偿
+func (c *Command) CatchUp() string {
+	if c.catchUp == "" {
+		return CatchUpNone
+	}
+	return c.catchUp
+}
+
+//addRun 追加一条运行记录 只保留最近的记录
+func (c *Command) addRun(r RunRecord) {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	c.runs = append(c.runs, r)
+	if len(c.runs) > runHistorySize {
+		c.runs = c.runs[len(c.runs)-runHistorySize:]
+	}
+}
+
+//Runs 获取最近的运行记录
+func (c *Command) Runs() []RunRecord {
+	c.runLock.Lock()
+	defer c.runLock.Unlock()
+	runs := make([]RunRecord, len(c.runs))
+	copy(runs, c.runs)
+	return runs
+}
+
 //NewCommand 返回一个等待执行的cmd结构体
 func NewCommand(cmd string, args []string, output string) *Command {
 	return &Command{
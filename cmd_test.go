@@ -1,9 +1,12 @@
 package taskeeper
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 )
 
 func TestCmd(t *testing.T) {
@@ -42,3 +45,58 @@ func TestCmd(t *testing.T) {
 	t.Logf("cmd id: %s \n", id)
 
 }
+
+func TestCmdTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signal stop not supported on windows")
+	}
+	useTempRunDir(t)
+	cmd := NewCommand("/bin/sleep", []string{"10"}, "/dev/null")
+	cmd.SetID("timeoutId")
+	cmd.SetTimeout(200*time.Millisecond).SetStopSignal(os.Interrupt, time.Second)
+
+	start := time.Now()
+	doCronRoutine(cmd)
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("timeout did not stop the process")
+	}
+	runs := cmd.Runs()
+	if len(runs) != 1 {
+		t.Fatalf("run history length %d", len(runs))
+	}
+	if runs[0].Result != RunResultTimeout {
+		t.Fatalf("run result %s", runs[0].Result)
+	}
+	t.Logf("run : %#v\n", runs[0])
+}
+
+func TestCmdSeparateOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("need /bin/sh")
+	}
+	dir, err := ioutil.TempDir("", "taskeeper-output")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	stdout := filepath.Join(dir, "out.log")
+	stderr := filepath.Join(dir, "err.log")
+	cmd := NewCommand("/bin/sh", []string{"-c", "echo out; echo err >&2"}, "")
+	cmd.SetStdout(stdout).SetStderr(stderr)
+	if cmd.Start() <= 0 {
+		t.Fatal("start failed")
+	}
+	cmd.Wait()
+
+	out, _ := ioutil.ReadFile(stdout)
+	errOut, _ := ioutil.ReadFile(stderr)
+	if string(out) != "out\n" || string(errOut) != "err\n" {
+		t.Fatalf("stdout %q stderr %q", out, errOut)
+	}
+
+	cmd.SetStderr(StderrToStdout)
+	if cmd.Stderr() != stdout {
+		t.Fatalf("merged stderr %s", cmd.Stderr())
+	}
+}
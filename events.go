@@ -0,0 +1,177 @@
+package taskeeper
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//订阅者的事件缓存 写满时断开订阅者
+const subscriberBuffer = 256
+
+//可以订阅的事件
+var streamEvents = map[string]bool{
+	EventStart:    true,
+	EventExit:     true,
+	EventRestart:  true,
+	EventBroken:   true,
+	EventWatchdog: true,
+	EventCronFire: true,
+	EventCronDone: true,
+	EventTimeout:  true,
+	EventReload:   true,
+	EventPause:    true,
+	EventResume:   true,
+}
+
+//subscriber 事件的订阅者
+type subscriber struct {
+	name   string      //只接收该命令的事件 名称或id
+	group  string      //只接收该分组的事件
+	user   *rbacUser   //配置了用户时 只接收用户可以查询的命令的事件
+	events chan *Event //待发送的事件 订阅者过慢时关闭
+	closed bool        //是否已经关闭
+}
+
+var (
+	//subLock 订阅者的锁
+	subLock sync.Mutex
+	//subscribers 当前的订阅者
+	subscribers = make(map[*subscriber]bool)
+)
+
+//添加一个订阅者 name和group为空时接收所有事件
+func subscribe(name, group string, u *rbacUser) *subscriber {
+	s := &subscriber{name: name, group: group, user: u, events: make(chan *Event, subscriberBuffer)}
+	subLock.Lock()
+	subscribers[s] = true
+	subLock.Unlock()
+	return s
+}
+
+//取消订阅
+func (s *subscriber) unsubscribe() {
+	subLock.Lock()
+	delete(subscribers, s)
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	subLock.Unlock()
+}
+
+//当前的订阅者数量
+func subscriberCount() int {
+	subLock.Lock()
+	defer subLock.Unlock()
+	return len(subscribers)
+}
+
+//订阅者是否接收事件 没有命令的keeper事件总是接收
+func (s *subscriber) match(e *Event) bool {
+	if e.ID == "" {
+		return true
+	}
+	if s.name != "" && s.name != e.Name && s.name != e.ID {
+		return false
+	}
+	if s.user != nil && !s.user.canStat(e.Name, e.Group) {
+		return false
+	}
+	return s.group == "" || s.group == e.Group
+}
+
+//发布事件 不会阻塞调用方
+//订阅者的缓存写满时断开该订阅者 避免拖慢进程管理
+func publishEvent(e *Event) {
+	if !streamEvents[e.Type] {
+		return
+	}
+	subLock.Lock()
+	defer subLock.Unlock()
+	for s := range subscribers {
+		if !s.match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			log.Println("event subscriber too slow, disconnected")
+			delete(subscribers, s)
+			s.closed = true
+			close(s.events)
+		}
+	}
+}
+
+//判断json请求是否是订阅请求
+func isSubscribeRequest(line []byte) (Request, bool) {
+	var req Request
+	if err := json.Unmarshal(line, &req); err != nil {
+		return req, false
+	}
+	return req, req.Method == MethodSubscribe
+}
+
+//处理订阅请求 校验通过后先返回成功的响应 然后每个事件输出一行json 直到客户端断开
+func streamSubscribe(c net.Conn, reader *bufio.Reader, p *peer, req Request) {
+	defer c.Close()
+	start := time.Now()
+	resp := Response{V: ProtocolVersion, ID: req.ID}
+	if req.V != ProtocolVersion {
+		resp.Error = &ResponseError{ErrResVersion, ErrMsgMap[ErrResVersion] + " : " + strconv.Itoa(req.V)}
+	} else {
+		identity, errmsg, errcode := p.authorize(req.Token, MethodSubscribe, req.Params.Name)
+		if errcode == ErrResCodeNo && req.Params.Name != "" {
+			if _, ok := findCmd(req.Params.Name); !ok {
+				errmsg, errcode = ErrMsgMap[ErrResNoCmd]+" : {"+req.Params.Name+"}", ErrResNoCmd
+			}
+		}
+		auditRequest(p, identity, MethodSubscribe, req.Params.Name, errcode, start)
+		if errcode != ErrResCodeNo {
+			resp.Error = &ResponseError{errcode, errmsg}
+		}
+	}
+	if resp.Error != nil {
+		data, _ := json.Marshal(resp)
+		c.Write(append(data, '\n'))
+		return
+	}
+
+	s := subscribe(req.Params.Name, req.Params.Group, p.roleUser(req.Token))
+	defer s.unsubscribe()
+	resp.Result = json.RawMessage(`"ok"`)
+	data, _ := json.Marshal(resp)
+	if _, err := c.Write(append(data, '\n')); err != nil {
+		return
+	}
+	//客户端断开后停止推送
+	stop := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, reader)
+		close(stop)
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case e, ok := <-s.events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err = c.Write(append(data, '\n')); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package taskeeper
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	server, conn := net.Pipe()
+	go listenHandle(server)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	readLine := func() []byte {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return line
+	}
+
+	conn.Write([]byte(`{"v":1,"id":3,"method":"subscribe","params":{"group":"web"}}` + "\n"))
+	var resp Response
+	if err := json.Unmarshal(readLine(), &resp); err != nil || resp.ID != 3 || resp.Error != nil {
+		t.Fatalf("subscribe response %+v %v", resp, err)
+	}
+
+	web := NewCommand("/bin/true", nil, "").SetGroup("web")
+	web.SetID("subweb")
+	db := NewCommand("/bin/true", nil, "").SetGroup("db")
+	db.SetID("subdb")
+	go func() {
+		logEvent(newEvent(LevelInfo, EventStart, db, "db started"))
+		logEvent(newEvent(LevelDebug, EventCronFire, web, "web fired"))
+		//不可订阅的事件不推送
+		logEvent(newEvent(LevelInfo, EventCtl, nil, "ctl start"))
+		logEvent(newEvent(LevelInfo, EventReload, nil, "reloaded"))
+	}()
+	for _, want := range []string{EventCronFire, EventReload} {
+		var e Event
+		if err := json.Unmarshal(readLine(), &e); err != nil || e.Type != want {
+			t.Fatalf("event %+v %v, want %s", e, err, want)
+		}
+		if want == EventCronFire && (e.ID != "subweb" || e.Group != "web") {
+			t.Errorf("event command %+v", e)
+		}
+	}
+
+	//客户端断开后取消订阅
+	conn.Close()
+	for i := 0; i < 100; i++ {
+		if subscriberCount() == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("subscriber not removed after disconnect")
+}
+
+func TestSubscribeErrors(t *testing.T) {
+	server, conn := net.Pipe()
+	go listenHandle(server)
+	defer conn.Close()
+	conn.Write([]byte(`{"v":1,"id":4,"method":"subscribe","params":{"name":"none|such"}}` + "\n"))
+	var resp Response
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil || json.Unmarshal(line, &resp) != nil || resp.Error == nil || resp.Error.Code != ErrResNoCmd {
+		t.Fatalf("subscribe response %q %v", line, err)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	s := subscribe("", "", nil)
+	defer s.unsubscribe()
+	for i := 0; i <= subscriberBuffer; i++ {
+		publishEvent(newEvent(LevelInfo, EventReload, nil, "reloaded"))
+	}
+	n := 0
+	for range s.events {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("received %d events", n)
+	}
+	subLock.Lock()
+	defer subLock.Unlock()
+	if subscribers[s] {
+		t.Error("slow subscriber not removed")
+	}
+}
+
+func TestSubscribeDuringReload(t *testing.T) {
+	oldCmds, oldNames := currentCmds()
+	defer setCmds(oldCmds, oldNames)
+	//重载时整体替换命令 订阅请求按名称查找命令
+	reload := func() {
+		c := NewCommand("/bin/true", nil, "").SetName("subreload")
+		setCmds(map[string]*Command{c.ID(): c}, map[string]string{c.Name(): c.ID()})
+	}
+	reload()
+	stop := make(chan struct{})
+	reloaded := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-reloaded
+	}()
+	go func() {
+		defer close(reloaded)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				reload()
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		server, conn := net.Pipe()
+		go listenHandle(server)
+		conn.Write([]byte(`{"v":1,"id":5,"method":"subscribe","params":{"name":"subreload"}}` + "\n"))
+		var resp Response
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		conn.Close()
+		if err != nil || json.Unmarshal(line, &resp) != nil || resp.Error != nil {
+			t.Fatalf("subscribe response %q %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package taskeeper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//钩子名称 全局和命令中使用同名的配置项
+const (
+	HookStart       = "on_start"        //进程启动或重启
+	HookExit        = "on_exit"         //进程退出
+	HookBroken      = "on_broken"       //重试次数超限 不再启动
+	HookCronFailure = "on_cron_failure" //cron执行失败或超时
+	HookReload      = "on_reload"       //重载配置 只有全局配置
+)
+
+//可以配置的钩子
+var hookNames = []string{HookStart, HookExit, HookBroken, HookCronFailure, HookReload}
+
+//DefaultHookTimeout 钩子默认的超时时间
+const DefaultHookTimeout = 10 * time.Second
+
+//同时执行的钩子数量上限 超过时丢弃 避免阻塞进程管理
+const maxRunningHooks = 32
+
+//钩子输出失败原因时附带的最大字节数
+const hookOutputTail = 512
+
+//钩子命令超时被结束后 等待输出管道关闭的最长时间
+//钩子启动的后台子进程继承输出管道时 不再等待其退出
+const hookWaitDelay = time.Second
+
+//Hook 事件触发的脚本或webhook
+type Hook struct {
+	Exec    string        //执行的命令 通过环境变量和标准输入接收事件
+	Args    []string      //命令的参数
+	URL     string        //以POST方式发送事件json的地址
+	Timeout time.Duration //超时时间
+}
+
+//HookPayload 发送给钩子的事件内容
+type HookPayload struct {
+	Hook   string `json:"hook"`             //钩子名称
+	Result string `json:"result,omitempty"` //cron执行结果
+	*Event
+}
+
+var (
+	//globalHooks 全局配置的钩子 按钩子名称保存
+	globalHooks map[string][]*Hook
+	//hookLock 全局钩子的读写锁
+	hookLock sync.RWMutex
+	//hookSlots 正在执行的钩子
+	hookSlots = make(chan struct{}, maxRunningHooks)
+)
+
+//String 钩子的执行目标
+func (h *Hook) String() string {
+	if h.URL != "" {
+		return h.URL
+	}
+	return h.Exec
+}
+
+//SetHooks 设置命令的钩子 与全局钩子一起触发
+func (c *Command) SetHooks(hooks map[string][]*Hook) *Command {
+	c.hooks = hooks
+	return c
+}
+
+//设置全局钩子
+func setGlobalHooks(hooks map[string][]*Hook) {
+	hookLock.Lock()
+	globalHooks = hooks
+	hookLock.Unlock()
+}
+
+//读取配置中的钩子 global为false时不支持on_reload
+//on_broken: "https://example.com/page" 字符串以http开头时为webhook 否则为执行的命令
+//on_exit: {exec: "/bin/notify", args: ["exit"], timeout: "5s"} 也可以配置为列表
+func buildHooks(cnf *configurator.Config, global bool) (map[string][]*Hook, error) {
+	var hooks map[string][]*Hook
+	for _, name := range hookNames {
+		block := cnf.Get(name)
+		if block.IsNil() {
+			continue
+		}
+		if name == HookReload && !global {
+			return nil, errors.New(name + " error : only supported in global config")
+		}
+		var list []*configurator.Config
+		if items, err := block.Array(); err == nil {
+			for _, item := range items {
+				list = append(list, configurator.BuildConfig(item))
+			}
+		} else {
+			list = append(list, block)
+		}
+		for _, item := range list {
+			h, err := buildHook(item)
+			if err != nil {
+				return nil, errors.New(name + " error : " + err.Error())
+			}
+			if hooks == nil {
+				hooks = make(map[string][]*Hook)
+			}
+			hooks[name] = append(hooks[name], h)
+		}
+	}
+	return hooks, nil
+}
+
+//解析单个钩子
+func buildHook(cnf *configurator.Config) (*Hook, error) {
+	h := &Hook{Timeout: DefaultHookTimeout}
+	if s, err := cnf.String(); err == nil {
+		if isHookURL(s) {
+			h.URL = s
+		} else {
+			h.Exec = s
+		}
+	} else {
+		h.Exec, _ = cnf.Get("exec").String()
+		h.Args, _ = cnf.Get("args").ArrayString()
+		h.URL, _ = cnf.Get("url").String()
+		timeout, err := getDuration(cnf.Get("timeout"))
+		if err != nil {
+			return nil, errors.New("timeout " + err.Error())
+		}
+		if timeout > 0 {
+			h.Timeout = timeout
+		}
+	}
+	switch {
+	case h.Exec == "" && h.URL == "":
+		return nil, errors.New("exec or url required")
+	case h.Exec != "" && h.URL != "":
+		return nil, errors.New("exec and url can not be used together")
+	case h.URL != "" && !isHookURL(h.URL):
+		return nil, errors.New("invalid url " + h.URL)
+	}
+	if h.Exec != "" {
+		h.Exec = getAbsPath(h.Exec)
+	}
+	return h, nil
+}
+
+//是否是webhook地址
+func isHookURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+//触发钩子 命令为nil时只触发全局钩子
+//钩子在协程中执行 不会阻塞调用方
+func fireHooks(name string, c *Command, e *Event, result string) {
+	hookLock.RLock()
+	hooks := append([]*Hook(nil), globalHooks[name]...)
+	hookLock.RUnlock()
+	if c != nil {
+		hooks = append(hooks, c.hooks[name]...)
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	p := &HookPayload{Hook: name, Result: result, Event: e}
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Println("hook " + name + " encode error : " + err.Error())
+		return
+	}
+	for _, h := range hooks {
+		select {
+		case hookSlots <- struct{}{}:
+			go func(h *Hook) {
+				defer func() { <-hookSlots }()
+				runHook(h, p, data)
+			}(h)
+		default:
+			logEvent(newEvent(LevelWarn, EventHook, c, "hook "+name+" "+h.String()+" dropped : too many running hooks"))
+		}
+	}
+}
+
+//执行单个钩子 失败时记录日志
+func runHook(h *Hook, p *HookPayload, data []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	var err error
+	if h.URL != "" {
+		err = postHook(ctx, h.URL, data)
+	} else {
+		err = execHook(ctx, h, p, data)
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("timeout after " + h.Timeout.String())
+	}
+	e := newEvent(LevelDebug, EventHook, nil, "hook "+p.Hook+" "+h.String()+" done")
+	if err != nil {
+		e = newEvent(LevelWarn, EventHook, nil, "hook "+p.Hook+" "+h.String()+" failed : "+err.Error())
+	}
+	e.Name, e.ID = p.Name, p.ID
+	logEvent(e)
+}
+
+//以POST方式发送事件
+func postHook(ctx context.Context, url string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("status " + resp.Status)
+	}
+	return nil
+}
+
+//执行命令 事件内容通过环境变量和标准输入传递
+func execHook(ctx context.Context, h *Hook, p *HookPayload, data []byte) error {
+	cmd := exec.CommandContext(ctx, h.Exec, h.Args...)
+	cmd.Env = append(os.Environ(), hookEnv(p)...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.WaitDelay = hookWaitDelay
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) > 0 {
+		if len(out) > hookOutputTail {
+			out = out[len(out)-hookOutputTail:]
+		}
+		err = errors.New(err.Error() + ", output : " + strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+//钩子命令的环境变量
+func hookEnv(p *HookPayload) []string {
+	env := []string{
+		"TASKEEPER_HOOK=" + p.Hook,
+		"TASKEEPER_EVENT=" + p.Type,
+		"TASKEEPER_TIME=" + p.Time,
+		"TASKEEPER_CMD_NAME=" + p.Name,
+		"TASKEEPER_CMD_ID=" + p.ID,
+		"TASKEEPER_CMD_GROUP=" + p.Group,
+		"TASKEEPER_RESULT=" + p.Result,
+		"TASKEEPER_MSG=" + p.Msg,
+	}
+	if p.Pid > 0 {
+		env = append(env, "TASKEEPER_PID="+strconv.Itoa(p.Pid))
+	}
+	if p.ExitCode != nil {
+		env = append(env, "TASKEEPER_EXIT_CODE="+strconv.Itoa(*p.ExitCode))
+	}
+	return env
+}
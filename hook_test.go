@@ -0,0 +1,154 @@
+package taskeeper
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+func TestBuildHooks(t *testing.T) {
+	hooks, err := buildHooks(configurator.BuildConfig(map[string]interface{}{
+		"on_broken": "https://example.com/page",
+		"on_exit": map[interface{}]interface{}{
+			"exec":    "/bin/notify",
+			"args":    []interface{}{"exit"},
+			"timeout": "3s",
+		},
+		"on_reload": []interface{}{"/bin/reloaded", map[interface{}]interface{}{"url": "http://127.0.0.1/reload"}},
+	}), true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if h := hooks[HookBroken]; len(h) != 1 || h[0].URL != "https://example.com/page" || h[0].Timeout != DefaultHookTimeout {
+		t.Errorf("on_broken %+v", h)
+	}
+	if h := hooks[HookExit]; len(h) != 1 || h[0].Exec != "/bin/notify" || len(h[0].Args) != 1 || h[0].Timeout != 3*time.Second {
+		t.Errorf("on_exit %+v", h)
+	}
+	if h := hooks[HookReload]; len(h) != 2 || h[0].Exec != "/bin/reloaded" || h[1].URL != "http://127.0.0.1/reload" {
+		t.Errorf("on_reload %+v", h)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"on_start": map[interface{}]interface{}{"timeout": "1s"}},
+		{"on_start": map[interface{}]interface{}{"exec": "/bin/true", "url": "http://127.0.0.1/"}},
+		{"on_start": map[interface{}]interface{}{"url": "ftp://127.0.0.1/"}},
+		{"on_reload": "/bin/true"},
+	} {
+		if _, err := buildHooks(configurator.BuildConfig(bad), false); err == nil {
+			t.Errorf("hooks %v should fail", bad)
+		}
+	}
+}
+
+func TestExecHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskeeper-hook")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "hook.out")
+
+	c := NewCommand("/bin/true", nil, "")
+	c.SetID("hookexec")
+	c.SetName("hookexec")
+	c.SetGroup("jobs")
+	c.SetHooks(map[string][]*Hook{HookCronFailure: {{
+		Exec:    "/bin/sh",
+		Args:    []string{"-c", `echo "$TASKEEPER_HOOK $TASKEEPER_CMD_NAME $TASKEEPER_CMD_GROUP $TASKEEPER_EXIT_CODE $TASKEEPER_RESULT" > ` + out + `.tmp; cat >> ` + out + `.tmp; mv ` + out + `.tmp ` + out},
+		Timeout: 5 * time.Second,
+	}}})
+	e := newEvent(LevelWarn, EventExit, c, "cron failed").withExitCode(3)
+	fireHooks(HookCronFailure, c, e, RunResultFailed)
+	//未配置的钩子不执行
+	fireHooks(HookStart, c, e, "")
+
+	var data []byte
+	for i := 0; i < 500 && len(data) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		data, _ = ioutil.ReadFile(out)
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	if len(lines) != 2 || lines[0] != "on_cron_failure hookexec jobs 3 failed" {
+		t.Fatalf("hook output %q", data)
+	}
+	var p HookPayload
+	if err := json.Unmarshal([]byte(lines[1]), &p); err != nil {
+		t.Fatal(err.Error())
+	}
+	if p.Hook != HookCronFailure || p.Event == nil || p.Type != EventExit || p.ID != "hookexec" || *p.ExitCode != 3 || p.Group != "jobs" {
+		t.Errorf("hook payload %s", lines[1])
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	received := make(chan *HookPayload, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			ioutil.ReadAll(r.Body)
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		p := &HookPayload{}
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(p) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		received <- p
+	}))
+	defer srv.Close()
+
+	old := globalHooks
+	defer setGlobalHooks(old)
+	setGlobalHooks(map[string][]*Hook{HookReload: {
+		{URL: srv.URL + "/slow", Timeout: 100 * time.Millisecond},
+		{URL: srv.URL + "/hook", Timeout: time.Second},
+	}})
+
+	//钩子不阻塞调用方
+	begin := time.Now()
+	fireHooks(HookReload, nil, newEvent(LevelInfo, EventReload, nil, "reloaded"), "")
+	if d := time.Since(begin); d > 50*time.Millisecond {
+		t.Errorf("fireHooks blocked for %s", d)
+	}
+	select {
+	case p := <-received:
+		if p.Hook != HookReload || p.Event == nil || p.Type != EventReload || p.Msg != "reloaded" {
+			t.Errorf("webhook payload %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not received")
+	}
+	//超时的钩子释放执行位置
+	for i := 0; i < 100 && len(hookSlots) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(hookSlots); n != 0 {
+		t.Errorf("%d hooks still running after timeout", n)
+	}
+}
+
+func TestExecHookTimeout(t *testing.T) {
+	//后台子进程持有输出管道时 超时后不等待其退出
+	h := &Hook{Exec: "/bin/sh", Args: []string{"-c", "sleep 5 & sleep 5"}, Timeout: 100 * time.Millisecond}
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+	start := time.Now()
+	if err := execHook(ctx, h, &HookPayload{Hook: HookExit, Event: newEvent(LevelInfo, EventExit, nil, "exit")}, nil); err == nil {
+		t.Error("hook not timed out")
+	}
+	if d := time.Since(start); d > h.Timeout+hookWaitDelay+2*time.Second {
+		t.Errorf("hook returned after %s", d)
+	}
+}
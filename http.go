@@ -0,0 +1,163 @@
+package taskeeper
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//HTTPPrefix http控制接口的路径前缀
+const HTTPPrefix = "/v1/"
+
+//http控制接口读取请求头和保持空闲连接的超时时间
+//命令输出和exec的响应时间不固定 不设置写超时
+const (
+	httpReadHeaderTimeout = 10 * time.Second
+	httpIdleTimeout       = 2 * time.Minute
+)
+
+var (
+	//httpAddr http控制接口的监听地址 为空时不启动
+	httpAddr string
+	//httpServer http控制接口服务
+	httpServer *http.Server
+)
+
+//错误编号对应的http状态码 未列出的为400
+var errCodeHTTPStatus = map[int]int{
+	ErrResNoCmd:     http.StatusNotFound,
+	ErrResUdfMethod: http.StatusNotFound,
+	ErrResAuth:      http.StatusUnauthorized,
+	ErrResDenied:    http.StatusForbidden,
+}
+
+//启动http控制接口
+func httpListen() {
+	if httpAddr == "" {
+		return
+	}
+	log.Println("http listen service starting ...")
+	ln, err := net.Listen("tcp", httpAddr)
+	if err != nil {
+		log.Fatalln("http listen start faild : " + err.Error())
+	}
+	httpServer = &http.Server{
+		Handler:           newHTTPHandler(),
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	go func() {
+		if err := httpServer.Serve(tlsListener(ln)); err != nil && err != http.ErrServerClosed {
+			log.Println("http listen service error : " + err.Error())
+		}
+	}()
+	log.Println("http listen service started at " + httpAddr)
+}
+
+//关闭http控制接口
+func stopHTTPListen() {
+	if httpServer != nil {
+		httpServer.Close()
+		httpServer = nil
+		log.Println("http listen service stopped")
+	}
+}
+
+//http控制接口的路由
+//GET  /v1/status /v1/config /v1/audit?lines={n} /v1/commands /v1/commands/{name} /v1/commands/{name}/output
+//POST /v1/commands/{name}/{start|stop|restart|pause|exec} /v1/reload /v1/shutdown
+//GET  /metrics prometheus文本格式的指标
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(HTTPPrefix, serveHTTPAPI)
+	mux.HandleFunc(MetricsPath, serveMetrics)
+	return mux
+}
+
+//处理http请求 转换为方法后与其他协议使用同一个处理
+func serveHTTPAPI(w http.ResponseWriter, r *http.Request) {
+	method, params, allow := httpRoute(strings.Trim(strings.TrimPrefix(r.URL.Path, HTTPPrefix), "/"))
+	if method == "" {
+		writeHTTPResponse(w, http.StatusNotFound, &ResponseError{ErrResUdfMethod, ErrMsgMap[ErrResUdfMethod] + " : {" + r.URL.Path + "}"}, nil)
+		return
+	}
+	if r.Method != allow {
+		w.Header().Set("Allow", allow)
+		writeHTTPResponse(w, http.StatusMethodNotAllowed, &ResponseError{ErrResWrgMsg, ErrMsgMap[ErrResWrgMsg] + " : " + r.Method + " " + r.URL.Path}, nil)
+		return
+	}
+	//token通过 `Authorization: Bearer {token}` 传递
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if method == MethodAudit {
+		params.Lines, _ = strconv.Atoi(r.URL.Query().Get("lines"))
+	}
+	result, errcode := dispatch(httpPeer(r), token, method, params)
+	if errcode == ErrResAuth {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	if errcode != ErrResCodeNo {
+		msg, _ := result.(string)
+		status, ok := errCodeHTTPStatus[errcode]
+		if !ok {
+			status = http.StatusBadRequest
+		}
+		writeHTTPResponse(w, status, &ResponseError{errcode, msg}, nil)
+		return
+	}
+	writeHTTPResponse(w, http.StatusOK, nil, result)
+}
+
+//按http请求创建客户端信息 开启tls时读取客户端证书的权限
+func httpPeer(r *http.Request) *peer {
+	p := &peer{addr: r.RemoteAddr}
+	if r.TLS != nil {
+		p.identity, p.perm = certPerm(r.TLS)
+	}
+	return p
+}
+
+//按路径匹配方法和参数 返回允许的http方法
+func httpRoute(path string) (string, RequestParams, string) {
+	var params RequestParams
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 1 && (parts[0] == MethodStatus || parts[0] == MethodConfig || parts[0] == MethodAudit):
+		return parts[0], params, http.MethodGet
+	case len(parts) == 1 && (parts[0] == MethodReload || parts[0] == MethodShutdown):
+		return parts[0], params, http.MethodPost
+	case parts[0] != MethodCommands:
+		return "", params, ""
+	case len(parts) == 1:
+		return MethodCommands, params, http.MethodGet
+	}
+	params.Name = parts[1]
+	if params.Name == "" || len(parts) > 3 {
+		return "", params, ""
+	}
+	if len(parts) == 2 {
+		return MethodCommand, params, http.MethodGet
+	}
+	if parts[2] == MethodOutput {
+		return MethodOutput, params, http.MethodGet
+	}
+	if _, ok := methodActs[parts[2]]; ok {
+		return parts[2], params, http.MethodPost
+	}
+	return "", params, ""
+}
+
+//写入json响应 格式与json协议的响应相同 没有id
+func writeHTTPResponse(w http.ResponseWriter, status int, e *ResponseError, result interface{}) {
+	resp := Response{V: ProtocolVersion, Error: e}
+	if e == nil {
+		resp.Result, _ = json.Marshal(result)
+	}
+	data, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
@@ -0,0 +1,70 @@
+package taskeeper
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPAPI(t *testing.T) {
+	oldCmds, oldNameMap := cmds, cmdNameMap
+	defer func() {
+		cmds, cmdNameMap = oldCmds, oldNameMap
+	}()
+	cmd := NewCommand("/bin/sleep", []string{"1"}, "")
+	cmd.SetName("http-test")
+	cmds = map[string]*Command{cmd.ID(): cmd}
+	cmdNameMap = map[string]string{cmd.Name(): cmd.ID()}
+
+	server := httptest.NewServer(newHTTPHandler())
+	defer server.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		status int
+		code   int
+	}{
+		{http.MethodGet, "/v1/commands", http.StatusOK, ErrResCodeNo},
+		{http.MethodGet, "/v1/commands/http-test", http.StatusOK, ErrResCodeNo},
+		{http.MethodGet, "/v1/commands/nosuch", http.StatusNotFound, ErrResNoCmd},
+		{http.MethodPost, "/v1/commands/nosuch/restart", http.StatusNotFound, ErrResNoCmd},
+		{http.MethodGet, "/v1/commands/http-test/restart", http.StatusMethodNotAllowed, ErrResWrgMsg},
+		{http.MethodPost, "/v1/status", http.StatusMethodNotAllowed, ErrResWrgMsg},
+		{http.MethodGet, "/v1/nothing", http.StatusNotFound, ErrResUdfMethod},
+		{http.MethodPost, "/v1/commands/http-test/jump", http.StatusNotFound, ErrResUdfMethod},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, server.URL+c.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var resp Response
+		err = json.NewDecoder(res.Body).Decode(&resp)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %s decode : %s", c.method, c.path, err.Error())
+		}
+		if res.StatusCode != c.status {
+			t.Errorf("%s %s status %d, want %d", c.method, c.path, res.StatusCode, c.status)
+		}
+		code := ErrResCodeNo
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		if code != c.code {
+			t.Errorf("%s %s code %d, want %d", c.method, c.path, code, c.code)
+		}
+		if c.path == "/v1/commands/http-test" {
+			var status CmdStatus
+			if json.Unmarshal(resp.Result, &status) != nil || status.Name != "http-test" {
+				t.Errorf("cmd result %s", resp.Result)
+			}
+		}
+		if res.StatusCode == http.StatusMethodNotAllowed && res.Header.Get("Allow") == "" {
+			t.Errorf("%s %s missing Allow header", c.method, c.path)
+		}
+	}
+}
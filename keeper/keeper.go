@@ -12,6 +12,8 @@ import (
 )
 
 func main() {
+	//由keeper启动的子进程 完成资源限制和cgroup的设置后执行命令
+	taskeeper.ExecChild()
 
 	//默认为前台运行 加参数-d 变为后台进程运行
 	deamon := flag.Bool("d", false, "is run in deamonize")
@@ -23,6 +25,8 @@ func main() {
 	forceLog := flag.Bool("flog", false, "is force to print log")
 
 	pprof := flag.Bool("pprof", false, "show runtime for testing")
+	//忽略状态文件 不恢复上次运行时暂停的命令等状态
+	ignoreState := flag.Bool("ignore-state", false, "ignore the saved runtime state file")
 
 	//解析命令行参数
 	flag.Parse()
@@ -46,6 +50,7 @@ func main() {
 	if !res && *workdir != "" {
 		log.Println("workdir did not change")
 	}
+	taskeeper.IgnoreState = *ignoreState
 	//启动
 	taskeeper.Start(*config, *deamon, *forceLog)
 }
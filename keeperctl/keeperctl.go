@@ -1,22 +1,59 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	tk "github.com/kasiss-liu/taskeeper"
+	"github.com/kasiss-liu/taskeeper/client"
 )
 
+//请求的超时时间
+const requestTimeout = 10 * time.Second
+
+//-s 对应的方法
+var signalMethods = map[string]string{
+	"reload": tk.MethodReload,
+	"start":  tk.MethodStart,
+	"exit":   tk.MethodShutdown,
+	"pause":  tk.MethodPause,
+}
+
+//-cat 对应的方法
+var catMethods = map[string]string{
+	"cmdlist": tk.MethodCommands,
+	"server":  tk.MethodStatus,
+	"config":  tk.MethodConfig,
+	"audit":   tk.MethodAudit,
+}
+
 func main() {
 	//接收输入
 	s := flag.String("s", "", `ctl signal 'exit' , 'reload'`)
 	h := flag.String("h", "", "service hostname : "+tk.DefaultHost)
 	p := flag.String("p", "", "service port : "+tk.DefaultPort)
 	cat := flag.String("cat", "", "cat cmd status")
+	tail := flag.String("tail", "", "print the last lines of cmd output")
+	lines := flag.Int("n", 0, "tail line number, or audit entry number")
+	follow := flag.Bool("f", false, "tail keep following new output")
+	stderr := flag.Bool("e", false, "tail the stderr output")
+	events := flag.Bool("events", false, "print keeper events live")
+	name := flag.String("name", "", "events only for the cmd name or id")
+	group := flag.String("group", "", "events only for the cmd group")
+	token := flag.String("token", os.Getenv("KEEPER_TOKEN"), "auth token, default $KEEPER_TOKEN")
+	cacert := flag.String("cacert", "", "ca file to verify keeper tls certificate")
+	cert := flag.String("cert", "", "client tls certificate file")
+	key := flag.String("key", "", "client tls key file")
 
 	flag.Parse()
 	//验证主机端口 可以配置远程tcp连接
@@ -24,87 +61,174 @@ func main() {
 		fmt.Println("hostname is input, need port string")
 		return
 	}
-	var addr string
+	//指定端口时使用tcp 否则从pid描述文件中读取 优先使用unix socket
+	var c *client.Client
 	if *p != "" {
-		addr = *h + ":" + *p
+		c = client.New("tcp", *h+":"+*p)
 	} else {
-		ps, err := tk.ParsePidDesc()
-		if err != nil {
+		var err error
+		if c, err = client.Discover(); err != nil {
 			fmt.Println("load pid desc error : " + err.Error())
 			return
 		}
-		addr = ps.TCPAddr
 	}
-	//解析请求字符串
-	requestString := getRequestData(*s, *cat)
-	if requestString == "" {
+	c.SetToken(*token)
+	//配置了任意证书时使用tls连接
+	if *cacert != "" || *cert != "" || *key != "" {
+		conf, err := client.LoadTLSConfig(*cacert, *cert, *key)
+		if err != nil {
+			fmt.Println("load tls config error : " + err.Error())
+			return
+		}
+		c.SetTLS(conf)
+	}
+	//tail请求会持续输出内容 使用文本协议
+	if *tail != "" {
+		conn, err := c.Dial(context.Background())
+		if err != nil {
+			fmt.Println("connect error : " + err.Error())
+			return
+		}
+		defer conn.Close()
+		n := *lines
+		if n <= 0 {
+			n = tk.DefaultTailLines
+		}
+		req := getTailRequest(*tail, n, *follow, *stderr)
+		if *token != "" {
+			req = tk.MsgAuth + " " + *token + " " + req
+		}
+		if _, err = conn.Write([]byte(req)); err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+		printTail(conn)
+		return
+	}
+	//持续打印事件 直到keeper断开或者手动结束
+	if *events {
+		err := c.Subscribe(context.Background(), *name, *group, func(e *tk.Event) {
+			data, _ := json.Marshal(e)
+			fmt.Println(string(data))
+		})
+		if err != nil && err != io.EOF {
+			fmt.Println(err.Error())
+		}
 		return
 	}
-	//如果解析成功 发起tcp请求
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		fmt.Println("connect error : " + err.Error())
+	//解析请求的方法和参数
+	method, params := getRequestData(*s, *cat)
+	if method == "" {
 		return
 	}
-	defer conn.Close()
-	n, err := conn.Write([]byte(requestString))
-	fmt.Println(requestString)
-	if err != nil {
-		fmt.Println(err.Error())
+	//审计日志按 -n 返回最近的条数
+	if method == tk.MethodAudit {
+		params.Lines = *lines
 	}
-	var buf = make([]byte, 1000, 1000)
-	n, err = conn.Read(buf)
-	if err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	var result json.RawMessage
+	if err := c.Call(ctx, method, params, &result); err != nil {
 		fmt.Println(err.Error())
 		return
 	}
-	//打印请求结果
-	data := string(buf[:n])
-	dataArr := strings.Split(data, "|")
-	fmt.Println(dataArr[len(dataArr)-1])
-
+	//命令的输出按原样打印
+	if method == tk.MethodOutput {
+		var output string
+		if json.Unmarshal(result, &output) == nil {
+			fmt.Print(output)
+			return
+		}
+	}
+	//审计记录每条打印一行 与日志文件的格式相同
+	if method == tk.MethodAudit {
+		var list []json.RawMessage
+		if json.Unmarshal(result, &list) == nil {
+			for _, e := range list {
+				fmt.Println(string(e))
+			}
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if json.Indent(&buf, result, "", "    ") != nil {
+		fmt.Println(string(result))
+		return
+	}
+	fmt.Println(buf.String())
 }
 
-//解析输入 返回请求的格式化数据
-func getRequestData(signal, cat string) string {
+//解析输入 返回请求的方法和参数
+func getRequestData(signal, cat string) (string, tk.RequestParams) {
+	var params tk.RequestParams
 	if signal != "" {
 		if _, ok := tk.SigMap[signal]; ok {
 			if signal == "act" {
 				if len(os.Args) < 5 {
-					return ""
-				}
-				os.Args[3] = switchAct(os.Args[3])
-				if os.Args[3] == "" {
-					return ""
+					return "", params
 				}
-				return tk.MsgSigCtl + " " + strings.Join(os.Args[2:], " ")
+				params.Name = os.Args[4]
+				return switchAct(os.Args[3]), params
 			}
-			return tk.MsgSigCtl + " " + signal
+			return signalMethods[signal], params
 		}
 		fmt.Println("undefined ctl " + signal)
-		return ""
+		return "", params
 	}
 	if cat != "" {
 		for k, arg := range tk.StatArgsMap {
 			if cat == arg {
 				if k > 0 {
-					return tk.MsgSigStat + " f " + cat
+					return catMethods[cat], params
 				}
-				return tk.MsgSigStat + " f " + cat + " " + getCmdID()
+				params.Name = getCmdID()
+				//查询命令最近的输出 `-cat cmd {id} output`
+				if os.Args[len(os.Args)-1] == tk.StatCmdOutput {
+					return tk.MethodOutput, params
+				}
+				return tk.MethodCommand, params
 			}
 		}
 		fmt.Println("undefined cat args : " + cat)
-		return ""
+		return "", params
 	}
 	fmt.Println("invalid input info : -s " + signal + " -cat " + cat)
-	return ""
+	return "", params
+}
+
+//tail请求的格式化数据
+func getTailRequest(name string, lines int, follow, stderr bool) string {
+	req := []string{tk.MsgSigStat, tk.StatTail, name, "-n", strconv.Itoa(lines)}
+	if follow {
+		req = append(req, "-f")
+	}
+	if stderr {
+		req = append(req, "-e")
+	}
+	return strings.Join(req, " ")
+}
+
+//打印tail的输出 跟踪模式下直到服务端断开或者手动结束
+func printTail(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil && header == "" {
+		fmt.Println(err.Error())
+		return
+	}
+	dataArr := strings.SplitN(strings.TrimSpace(header), "|", 3)
+	if len(dataArr) < 2 || dataArr[0] != "0" {
+		fmt.Println(dataArr[len(dataArr)-1])
+		return
+	}
+	io.Copy(os.Stdout, reader)
 }
 
 //ge查询cmd的id
 func getCmdID() string {
 	for k, v := range os.Args {
 		if v == tk.StatArgsMap[0] {
-			if len(os.Args) > k {
+			if len(os.Args) > k+1 {
 				return os.Args[k+1]
 			}
 			break
@@ -117,15 +241,15 @@ func switchAct(a string) string {
 
 	switch a {
 	case "reload":
-		return strconv.Itoa(tk.ActReload)
+		return tk.MethodRestart
 	case "start":
-		return strconv.Itoa(tk.ActStart)
+		return tk.MethodStart
 	case "exit":
-		return strconv.Itoa(tk.ActExit)
+		return tk.MethodStop
 	case "pause":
-		return strconv.Itoa(tk.ActPause)
+		return tk.MethodPause
 	case "exec":
-		return strconv.Itoa(tk.ActExec)
+		return tk.MethodExec
 	default:
 		fmt.Println("need act type!")
 		return ""
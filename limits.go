@@ -0,0 +1,163 @@
+package taskeeper
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//RlimitInfinity 不限制
+const RlimitInfinity = ^uint64(0)
+
+//可以配置的资源限制 core as stack 按字节 支持 K M G 后缀 cpu 按秒
+var limitNames = []string{"nofile", "nproc", "core", "as", "cpu", "stack"}
+
+//按字节配置的资源限制
+var limitSizes = map[string]bool{"core": true, "as": true, "stack": true}
+
+//Rlimit 资源限制的软限制和硬限制
+type Rlimit struct {
+	Soft uint64
+	Hard uint64
+}
+
+//String 格式化为 `soft:hard` 相同时只输出一个值
+func (r Rlimit) String() string {
+	if r.Soft == r.Hard {
+		return formatLimitValue(r.Soft)
+	}
+	return formatLimitValue(r.Soft) + ":" + formatLimitValue(r.Hard)
+}
+
+//格式化单个限制值
+func formatLimitValue(v uint64) string {
+	if v == RlimitInfinity {
+		return "unlimited"
+	}
+	return strconv.FormatUint(v, 10)
+}
+
+//读取命令的资源限制配置
+//limits: {nofile: 65536, nproc: "4096:8192", core: unlimited, as: "4G"}
+func buildLimits(cnf *configurator.Config) (map[string]Rlimit, error) {
+	list, _ := cnf.Get("limits").MapString()
+	if len(list) == 0 {
+		return nil, nil
+	}
+	limits := make(map[string]Rlimit, len(list))
+	for name, v := range list {
+		if _, ok := rlimitResources[name]; !ok {
+			return nil, errors.New("limits error : `" + name + "` is not supported on this system")
+		}
+		l, err := parseLimit(name, v)
+		if err != nil {
+			return nil, errors.New("limits error : " + name + " " + err.Error())
+		}
+		limits[name] = l
+	}
+	if err := checkLimits(limits); err != nil {
+		return nil, errors.New("limits error : " + err.Error())
+	}
+	return limits, nil
+}
+
+//解析单个资源限制 整数表示软硬限制相同 字符串支持 `soft:hard` 和 unlimited
+func parseLimit(name string, v interface{}) (Rlimit, error) {
+	var parts []string
+	switch val := v.(type) {
+	case int:
+		parts = []string{strconv.Itoa(val)}
+	case string:
+		parts = strings.Split(val, ":")
+	default:
+		return Rlimit{}, errors.New("invalid value type")
+	}
+	if len(parts) > 2 {
+		return Rlimit{}, errors.New("invalid value " + strings.Join(parts, ":"))
+	}
+	values := make([]uint64, len(parts))
+	for i, p := range parts {
+		n, err := parseLimitValue(name, strings.TrimSpace(p))
+		if err != nil {
+			return Rlimit{}, err
+		}
+		values[i] = n
+	}
+	l := Rlimit{Soft: values[0], Hard: values[len(values)-1]}
+	if l.Soft > l.Hard {
+		return Rlimit{}, errors.New("soft limit exceeds hard limit")
+	}
+	return l, nil
+}
+
+//解析单个限制值
+func parseLimitValue(name, s string) (uint64, error) {
+	switch strings.ToLower(s) {
+	case "unlimited", "infinity":
+		return RlimitInfinity, nil
+	case "":
+		return 0, errors.New("empty value")
+	}
+	if limitSizes[name] {
+		n, err := parseSize(s)
+		return uint64(n), err
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid value " + s)
+	}
+	return n, nil
+}
+
+//编码资源限制 用于传递给子进程 `nofile=1024:4096,core=0:0`
+func encodeLimits(limits map[string]Rlimit) string {
+	list := make([]string, 0, len(limits))
+	for name, l := range limits {
+		list = append(list, name+"="+strconv.FormatUint(l.Soft, 10)+":"+strconv.FormatUint(l.Hard, 10))
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+//解码资源限制
+func decodeLimits(s string) (map[string]Rlimit, error) {
+	limits := make(map[string]Rlimit)
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid limit " + item)
+		}
+		values := strings.SplitN(kv[1], ":", 2)
+		if len(values) != 2 {
+			return nil, errors.New("invalid limit " + item)
+		}
+		soft, err1 := strconv.ParseUint(values[0], 10, 64)
+		hard, err2 := strconv.ParseUint(values[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, errors.New("invalid limit " + item)
+		}
+		limits[kv[0]] = Rlimit{Soft: soft, Hard: hard}
+	}
+	return limits, nil
+}
+
+//命令的资源限制 运行中时读取进程实际生效的限制 否则返回配置的限制
+func cmdLimits(c *Command) map[string]string {
+	limits := c.limits
+	if c.Pid() > 0 {
+		if effective := readProcLimits(c.Pid()); effective != nil {
+			limits = effective
+		}
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	list := make(map[string]string, len(limits))
+	for name, l := range limits {
+		list[name] = l.String()
+	}
+	return list
+}
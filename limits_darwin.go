@@ -0,0 +1,4 @@
+package taskeeper
+
+//syscall包中没有RLIMIT_NPROC
+const rlimitNproc = 7
@@ -0,0 +1,14 @@
+package taskeeper
+
+import (
+	"runtime"
+	"strings"
+)
+
+//syscall包中没有RLIMIT_NPROC mips下为8 其他架构为6
+var rlimitNproc = func() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 8
+	}
+	return 6
+}()
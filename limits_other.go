@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package taskeeper
+
+//其他系统不支持资源限制
+var rlimitResources = map[string]int{}
+
+//其他系统不支持资源限制
+func checkLimits(limits map[string]Rlimit) error {
+	return nil
+}
@@ -0,0 +1,109 @@
+package taskeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//配置了资源限制或cgroup的命令由测试程序自身启动 完成设置后执行命令
+func TestMain(m *testing.M) {
+	ExecChild()
+	os.Exit(m.Run())
+}
+
+func TestParseLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits test only on linux")
+	}
+	cnf := configurator.BuildConfig(map[string]interface{}{
+		"limits": map[interface{}]interface{}{
+			"nofile": 1024,
+			"core":   "unlimited",
+			"as":     "1G:2G",
+			"cpu":    "60:120",
+		},
+	})
+	limits, err := buildLimits(cnf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := map[string]Rlimit{
+		"nofile": {1024, 1024},
+		"core":   {RlimitInfinity, RlimitInfinity},
+		"as":     {1 << 30, 2 << 30},
+		"cpu":    {60, 120},
+	}
+	for name, l := range want {
+		if limits[name] != l {
+			t.Errorf("%s : %v, want %v", name, limits[name], l)
+		}
+	}
+	decoded, err := decodeLimits(encodeLimits(limits))
+	if err != nil || len(decoded) != len(limits) || decoded["as"] != limits["as"] {
+		t.Errorf("decode %v %v", decoded, err)
+	}
+
+	for _, bad := range []map[interface{}]interface{}{
+		{"files": 10},
+		{"nofile": "2048:1024"},
+		{"nofile": "many"},
+		{"nofile": -1},
+		{"nproc": "1:2:3"},
+	} {
+		if _, err := buildLimits(configurator.BuildConfig(map[string]interface{}{"limits": bad})); err == nil {
+			t.Errorf("limits %v should fail", bad)
+		}
+	}
+}
+
+func TestCmdLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("limits test only on linux")
+	}
+	dir, err := ioutil.TempDir("", "taskeeper-limits")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out.log")
+
+	c := NewCommand("/bin/sh", []string{"-c", "ulimit -Sn; ulimit -Hn; ulimit -c"}, out)
+	c.SetLimits(map[string]Rlimit{"nofile": {200, 300}, "core": {0, 0}})
+	if c.Start() <= 0 {
+		t.Fatal("start failed")
+	}
+	if state, err := c.Wait(); err != nil || state.ExitCode() != 0 {
+		t.Fatalf("wait %v %v", state, err)
+	}
+	data, _ := ioutil.ReadFile(out)
+	if strings.Join(strings.Fields(string(data)), " ") != "200 300 0" {
+		t.Errorf("limits output %q", data)
+	}
+
+	//运行中时读取实际生效的限制
+	c = NewCommand("/bin/sleep", []string{"5"}, out)
+	c.SetLimits(map[string]Rlimit{"nofile": {200, 300}})
+	if c.Start() <= 0 {
+		t.Fatal("start failed")
+	}
+	defer c.Wait()
+	defer c.Kill()
+	//等待子进程设置限制后执行命令
+	for i := 0; i < 100; i++ {
+		if exe, _ := os.Readlink("/proc/" + strconv.Itoa(c.Pid()) + "/exe"); exe == "/bin/sleep" || exe == "/usr/bin/sleep" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if limits := cmdLimits(c); limits["nofile"] != "200:300" || limits["core"] == "" {
+		t.Errorf("effective limits %v", limits)
+	}
+}
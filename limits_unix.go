@@ -0,0 +1,51 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package taskeeper
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+//配置名称对应的资源
+var rlimitResources = map[string]int{
+	"nofile": syscall.RLIMIT_NOFILE,
+	"nproc":  rlimitNproc,
+	"core":   syscall.RLIMIT_CORE,
+	"as":     syscall.RLIMIT_AS,
+	"cpu":    syscall.RLIMIT_CPU,
+	"stack":  syscall.RLIMIT_STACK,
+}
+
+//设置子进程的资源限制
+func setChildLimits(spec string) error {
+	limits, err := decodeLimits(spec)
+	if err != nil {
+		return err
+	}
+	for name, l := range limits {
+		if err = syscall.Setrlimit(rlimitResources[name], &syscall.Rlimit{Cur: l.Soft, Max: l.Hard}); err != nil {
+			return errors.New(name + " " + err.Error())
+		}
+	}
+	return nil
+}
+
+//校验资源限制 非root用户不能提高硬限制
+func checkLimits(limits map[string]Rlimit) error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	for name, l := range limits {
+		var cur syscall.Rlimit
+		if err := syscall.Getrlimit(rlimitResources[name], &cur); err != nil {
+			return errors.New(name + " " + err.Error())
+		}
+		if l.Hard > cur.Max {
+			return errors.New(name + " hard limit " + formatLimitValue(l.Hard) + " exceeds keeper's " + formatLimitValue(cur.Max))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package taskeeper
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//日志格式
+const (
+	LogFormatText = "text" //普通文本
+	LogFormatJSON = "json" //每个事件一行json
+)
+
+//日志级别
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+//事件类型
+const (
+	EventStart    = "start"     //进程启动
+	EventExit     = "exit"      //进程退出
+	EventRestart  = "restart"   //进程重启
+	EventBroken   = "broken"    //重试次数超限 不再启动
+	EventCronFire = "cron_fire" //cron触发
+	EventCronDone = "cron_done" //cron或单次执行结束
+	EventTimeout  = "timeout"   //cron或单次执行超时
+	EventPause    = "pause"     //暂停
+	EventResume   = "resume"    //恢复运行
+	EventReload   = "reload"    //重载配置
+	EventCtl      = "ctl"       //收到控制命令
+	EventAuth     = "auth"      //请求校验失败
+	EventAudit    = "audit"     //控制操作的审计记录
+	EventWatchdog = "watchdog"  //资源超限后重启
+	EventHook     = "hook"      //钩子执行结果
+	EventLog      = "log"       //其他日志
+)
+
+//日志级别的顺序
+var levelOrder = map[string]int{
+	LevelDebug: 0,
+	LevelInfo:  1,
+	LevelWarn:  2,
+	LevelError: 3,
+}
+
+var (
+	//logFormat 当前的日志格式
+	logFormat = LogFormatText
+	//logLevel 低于该级别的事件不会输出
+	logLevel = LevelInfo
+	//logWriteLock json日志的写入锁
+	logWriteLock sync.Mutex
+)
+
+//Event keeper运行中的事件
+type Event struct {
+	Time     string `json:"time"`                //事件时间
+	Level    string `json:"level"`               //日志级别
+	Type     string `json:"event"`               //事件类型
+	Name     string `json:"name,omitempty"`      //命令名称
+	ID       string `json:"id,omitempty"`        //命令id
+	Group    string `json:"group,omitempty"`     //命令分组
+	Pid      int    `json:"pid,omitempty"`       //进程pid
+	ExitCode *int   `json:"exit_code,omitempty"` //退出码
+	Msg      string `json:"msg,omitempty"`       //文本消息
+}
+
+//创建一个事件 命令可以为nil
+func newEvent(level, typ string, c *Command, msg string) *Event {
+	e := &Event{
+		Time:  time.Now().UTC().Format(time.RFC3339Nano),
+		Level: level,
+		Type:  typ,
+		Msg:   msg,
+	}
+	if c != nil {
+		e.Name = c.Name()
+		e.ID = c.ID()
+		e.Group = c.Group()
+		if c.Pid() > 0 {
+			e.Pid = c.Pid()
+		}
+	}
+	return e
+}
+
+//设置事件的pid
+func (e *Event) withPid(pid int) *Event {
+	e.Pid = pid
+	return e
+}
+
+//设置事件的退出码
+func (e *Event) withExitCode(code int) *Event {
+	e.ExitCode = &code
+	return e
+}
+
+//输出一个事件 并推送给订阅者
+//文本格式下只输出消息 json格式下输出完整的事件
+func logEvent(e *Event) {
+	publishEvent(e)
+	if !levelEnabled(e.Level) {
+		return
+	}
+	//输出到syslog时 按事件级别设置严重级别
+	if w, ok := output.(*syslogWriter); ok {
+		msg := e.Msg
+		if logFormat == LogFormatJSON {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			msg = string(data)
+		}
+		w.writeSeverity(levelSeverity[e.Level], []byte(msg))
+		return
+	}
+	if logFormat != LogFormatJSON {
+		log.Println(e.Msg)
+		return
+	}
+	writeJSONLog(e)
+}
+
+//判断级别是否需要输出
+func levelEnabled(level string) bool {
+	return levelOrder[level] >= levelOrder[logLevel]
+}
+
+//以json格式写入日志位置
+func writeJSONLog(e *Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	logWriteLock.Lock()
+	defer logWriteLock.Unlock()
+	output.Write(append(data, '\n'))
+}
+
+//jsonLogWriter 将普通的日志行转换为json事件
+type jsonLogWriter struct{}
+
+//Write 每次写入为一行日志
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	if levelEnabled(LevelInfo) {
+		writeJSONLog(newEvent(LevelInfo, EventLog, nil, strings.TrimRight(string(p), "\n")))
+	}
+	return len(p), nil
+}
+
+//按日志格式设置log包的输出位置
+func applyLogOutput(w io.Writer) {
+	if logFormat == LogFormatJSON {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+		return
+	}
+	//syslog消息自带时间
+	if _, ok := w.(*syslogWriter); ok {
+		log.SetFlags(0)
+	} else {
+		log.SetFlags(log.LstdFlags)
+	}
+	log.SetOutput(w)
+}
+
+//读取日志格式和级别的配置
+func setLogOptions(format, level string) error {
+	switch format {
+	case "", LogFormatText:
+		logFormat = LogFormatText
+	case LogFormatJSON:
+		logFormat = LogFormatJSON
+	default:
+		return errors.New("log_format error : undefined format " + format)
+	}
+	if level == "" {
+		level = LevelInfo
+	}
+	if _, ok := levelOrder[level]; !ok {
+		return errors.New("log_level error : undefined level " + level)
+	}
+	logLevel = level
+	return nil
+}
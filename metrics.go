@@ -0,0 +1,349 @@
+package taskeeper
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//MetricsPath http服务上prometheus指标的路径
+const MetricsPath = "/metrics"
+
+//MethodMetrics 指标请求在鉴权和审计中的方法名 包含所有命令的指标 角色需要匹配所有命令
+const MethodMetrics = "metrics"
+
+//命令状态指标的取值
+const (
+	CmdStateRunning = "running" //正在运行
+	CmdStateStopped = "stopped" //常驻命令未运行
+	CmdStatePaused  = "paused"  //已暂停
+	CmdStateBroken  = "broken"  //重试次数超限 不再启动
+	CmdStateIdle    = "idle"    //cron命令等待下次执行
+)
+
+var cmdStates = []string{CmdStateRunning, CmdStateStopped, CmdStatePaused, CmdStateBroken, CmdStateIdle}
+
+//单次执行的结果
+var runResults = []string{RunResultSuccess, RunResultFailed, RunResultTimeout}
+
+//cron执行时长直方图的分桶 单位秒
+var cronDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+//cmdMetrics 单个命令的累计指标
+type cmdMetrics struct {
+	restarts  uint64            //进程退出后的自动重启次数
+	watchdogs uint64            //资源超限后的重启次数
+	brokens   uint64            //被标记中断的次数
+	exited    bool              //是否退出过
+	lastExit  int               //最近一次退出码
+	startTime time.Time         //最近一次启动的时间
+	runs      map[string]uint64 //单次执行按结果的次数
+	durCounts []uint64          //执行时长落入各分桶的次数 最后一个为+Inf
+	durSum    float64           //执行时长的总和
+}
+
+var (
+	//metricsLock 指标的锁
+	metricsLock sync.Mutex
+	//metricsStore 命令的指标 按名称保存 重载配置后保留
+	metricsStore = make(map[string]*cmdMetrics)
+	//reloadsTotal keeper启动后重载配置的次数
+	reloadsTotal uint64
+)
+
+//记录一次重载配置
+func metricReload() {
+	atomic.AddUint64(&reloadsTotal, 1)
+}
+
+//获取命令的指标 需要持有锁
+func metricsOf(c *Command) *cmdMetrics {
+	m, ok := metricsStore[c.Name()]
+	if !ok {
+		m = &cmdMetrics{runs: make(map[string]uint64), durCounts: make([]uint64, len(cronDurationBuckets)+1)}
+		metricsStore[c.Name()] = m
+	}
+	return m
+}
+
+//记录命令启动 restarted为进程退出后的自动重启
+func metricStarted(c *Command, restarted bool) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	m := metricsOf(c)
+	m.startTime = time.Now()
+	if restarted {
+		m.restarts++
+	}
+}
+
+//记录资源超限后的重启
+func metricWatchdogRestart(c *Command) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricsOf(c).watchdogs++
+}
+
+//命令的自动重启次数和资源超限后的重启次数
+func cmdRestarts(c *Command) (uint64, uint64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	m := metricsOf(c)
+	return m.restarts, m.watchdogs
+}
+
+//记录命令退出
+func metricExited(c *Command, code int) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	m := metricsOf(c)
+	m.exited = true
+	m.lastExit = code
+}
+
+//记录命令被标记中断
+func metricBroken(c *Command) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricsOf(c).brokens++
+}
+
+//记录一次单次执行的结果和时长
+func metricRun(c *Command, result string, d time.Duration) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	m := metricsOf(c)
+	m.runs[result]++
+	sec := d.Seconds()
+	m.durSum += sec
+	i := sort.SearchFloat64s(cronDurationBuckets, sec)
+	m.durCounts[i]++
+}
+
+//命令当前的状态
+func cmdState(c *Command) string {
+	switch {
+	case c.Pid() > 0:
+		return CmdStateRunning
+	case c.IsPause():
+		return CmdStatePaused
+	}
+	if _, ok := currentState().BrokenList[c.ID()]; ok {
+		return CmdStateBroken
+	}
+	if c.IsCron() {
+		return CmdStateIdle
+	}
+	return CmdStateStopped
+}
+
+//指标输出时的命令快照
+type cmdMetricsView struct {
+	labels string
+	cron   bool
+	state  string
+	m      cmdMetrics
+	usage  *ProcUsage
+}
+
+//生成prometheus文本格式的指标
+func renderMetrics() []byte {
+	all, _ := currentCmds()
+	list := make([]*Command, 0, len(all))
+	for _, c := range all {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name() < list[j].Name()
+	})
+
+	views := make([]cmdMetricsView, 0, len(list))
+	metricsLock.Lock()
+	for _, c := range list {
+		src := metricsOf(c)
+		m := *src
+		m.runs = make(map[string]uint64, len(src.runs))
+		for k, v := range src.runs {
+			m.runs[k] = v
+		}
+		m.durCounts = append([]uint64(nil), m.durCounts...)
+		views = append(views, cmdMetricsView{
+			labels: `name="` + escapeLabel(c.Name()) + `",group="` + escapeLabel(c.Group()) + `"`,
+			cron:   c.IsCron(),
+			state:  cmdState(c),
+			m:      m,
+			usage:  cmdUsage(c),
+		})
+	}
+	metricsLock.Unlock()
+
+	var buf bytes.Buffer
+	family := func(name, typ, help string) {
+		buf.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + typ + "\n")
+	}
+	sample := func(name, labels, value string) {
+		if labels != "" {
+			name += "{" + labels + "}"
+		}
+		buf.WriteString(name + " " + value + "\n")
+	}
+
+	uptime := int64(0)
+	if start := atomic.LoadInt64(&StartTime); start > 0 {
+		uptime = time.Now().Unix() - start
+	}
+	family("taskeeper_uptime_seconds", "gauge", "Seconds since the keeper started.")
+	sample("taskeeper_uptime_seconds", "", strconv.FormatInt(uptime, 10))
+	family("taskeeper_reloads_total", "counter", "Number of config reloads.")
+	sample("taskeeper_reloads_total", "", strconv.FormatUint(atomic.LoadUint64(&reloadsTotal), 10))
+
+	family("taskeeper_command_up", "gauge", "Whether the command process is running.")
+	for _, v := range views {
+		up := "0"
+		if v.state == CmdStateRunning {
+			up = "1"
+		}
+		sample("taskeeper_command_up", v.labels, up)
+	}
+	family("taskeeper_command_state", "gauge", "Current state of the command.")
+	for _, v := range views {
+		for _, s := range cmdStates {
+			value := "0"
+			if v.state == s {
+				value = "1"
+			}
+			sample("taskeeper_command_state", v.labels+`,state="`+s+`"`, value)
+		}
+	}
+	family("taskeeper_command_restarts_total", "counter", "Automatic restarts after the process exited.")
+	for _, v := range views {
+		sample("taskeeper_command_restarts_total", v.labels, strconv.FormatUint(v.m.restarts, 10))
+	}
+	family("taskeeper_command_watchdog_restarts_total", "counter", "Restarts after the process exceeded max_memory or max_cpu_percent.")
+	for _, v := range views {
+		sample("taskeeper_command_watchdog_restarts_total", v.labels, strconv.FormatUint(v.m.watchdogs, 10))
+	}
+	family("taskeeper_command_broken_total", "counter", "Times the command was marked broken.")
+	for _, v := range views {
+		sample("taskeeper_command_broken_total", v.labels, strconv.FormatUint(v.m.brokens, 10))
+	}
+	family("taskeeper_command_last_exit_code", "gauge", "Exit code of the last process exit, -1 when killed by a signal.")
+	for _, v := range views {
+		if v.m.exited {
+			sample("taskeeper_command_last_exit_code", v.labels, strconv.Itoa(v.m.lastExit))
+		}
+	}
+	family("taskeeper_command_start_time_seconds", "gauge", "Unix time of the last process start.")
+	for _, v := range views {
+		if !v.m.startTime.IsZero() {
+			sample("taskeeper_command_start_time_seconds", v.labels, strconv.FormatInt(v.m.startTime.Unix(), 10))
+		}
+	}
+
+	//运行中的命令输出进程树的资源使用
+	usageFamilies := []struct {
+		name  string
+		help  string
+		value func(u *ProcUsage) string
+	}{
+		{"taskeeper_command_cpu_percent", "CPU usage of the process tree since the last sample, 100 is one core.", func(u *ProcUsage) string { return formatFloat(u.CPUPercent) }},
+		{"taskeeper_command_rss_bytes", "Resident memory of the process tree.", func(u *ProcUsage) string { return strconv.FormatUint(u.RSS, 10) }},
+		{"taskeeper_command_virtual_memory_bytes", "Virtual memory of the process tree.", func(u *ProcUsage) string { return strconv.FormatUint(u.VMS, 10) }},
+		{"taskeeper_command_open_fds", "Open file descriptors of the process tree.", func(u *ProcUsage) string { return strconv.Itoa(u.FDs) }},
+		{"taskeeper_command_threads", "Threads of the process tree.", func(u *ProcUsage) string { return strconv.Itoa(u.Threads) }},
+		{"taskeeper_command_processes", "Processes in the process tree.", func(u *ProcUsage) string { return strconv.Itoa(u.Procs) }},
+	}
+	for _, f := range usageFamilies {
+		family(f.name, "gauge", f.help)
+		for _, v := range views {
+			if v.usage != nil {
+				sample(f.name, v.labels, f.value(v.usage))
+			}
+		}
+	}
+
+	//使用cgroup的命令输出cgroup的资源使用
+	cgroupFamilies := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(u *CgroupUsage) string
+	}{
+		{"taskeeper_command_cgroup_memory_bytes", "gauge", "memory.current of the command cgroup.", func(u *CgroupUsage) string { return strconv.FormatUint(u.MemoryCurrent, 10) }},
+		{"taskeeper_command_cgroup_cpu_seconds_total", "counter", "CPU time used by the command cgroup.", func(u *CgroupUsage) string { return formatFloat(float64(u.CPUUsageUsec) / 1e6) }},
+		{"taskeeper_command_cgroup_pids", "gauge", "pids.current of the command cgroup.", func(u *CgroupUsage) string { return strconv.Itoa(u.PidsCurrent) }},
+	}
+	for _, f := range cgroupFamilies {
+		family(f.name, f.typ, f.help)
+		for _, v := range views {
+			if v.usage != nil && v.usage.Cgroup != nil {
+				sample(f.name, v.labels, f.value(v.usage.Cgroup))
+			}
+		}
+	}
+
+	//cron命令和执行过act exec的命令输出执行指标
+	family("taskeeper_cron_runs_total", "counter", "Single runs of cron and exec commands by result.")
+	for _, v := range views {
+		if !v.cron && len(v.m.runs) == 0 {
+			continue
+		}
+		for _, r := range runResults {
+			sample("taskeeper_cron_runs_total", v.labels+`,result="`+r+`"`, strconv.FormatUint(v.m.runs[r], 10))
+		}
+	}
+	family("taskeeper_cron_run_duration_seconds", "histogram", "Duration of single runs of cron and exec commands.")
+	for _, v := range views {
+		if !v.cron && len(v.m.runs) == 0 {
+			continue
+		}
+		var count uint64
+		for i, le := range cronDurationBuckets {
+			count += v.m.durCounts[i]
+			sample("taskeeper_cron_run_duration_seconds_bucket", v.labels+`,le="`+formatFloat(le)+`"`, strconv.FormatUint(count, 10))
+		}
+		count += v.m.durCounts[len(cronDurationBuckets)]
+		sample("taskeeper_cron_run_duration_seconds_bucket", v.labels+`,le="+Inf"`, strconv.FormatUint(count, 10))
+		sample("taskeeper_cron_run_duration_seconds_sum", v.labels, formatFloat(v.m.durSum))
+		sample("taskeeper_cron_run_duration_seconds_count", v.labels, strconv.FormatUint(count, 10))
+	}
+	return buf.Bytes()
+}
+
+//处理http的指标请求 需要查询权限
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, ErrMsgMap[ErrResWrgMsg]+" : "+r.Method+" "+r.URL.Path, http.StatusMethodNotAllowed)
+		return
+	}
+	start := time.Now()
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	p := httpPeer(r)
+	identity, errmsg, errcode := p.authorize(token, MethodMetrics, "")
+	auditRequest(p, identity, MethodMetrics, "", errcode, start)
+	if errcode != ErrResCodeNo {
+		if errcode == ErrResAuth {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, errmsg, errCodeHTTPStatus[errcode])
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(renderMetrics())
+}
+
+//转义标签的值
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+//格式化浮点数
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,85 @@
+package taskeeper
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	oldCmds, oldStore := cmds, metricsStore
+	defer func() {
+		cmds, metricsStore = oldCmds, oldStore
+	}()
+	web := NewCommand("/bin/true", nil, "").SetName("web").SetGroup("front")
+	job := NewCommand("/bin/true", nil, "").SetName("job").SetCron("* * * * *")
+	web.SetID("webid")
+	job.SetID("jobid")
+	cmds = map[string]*Command{web.ID(): web, job.ID(): job}
+	metricsStore = make(map[string]*cmdMetrics)
+
+	metricStarted(web, false)
+	metricExited(web, 1)
+	metricStarted(web, true)
+	metricStarted(web, true)
+	metricBroken(web)
+	metricRun(job, RunResultSuccess, 200*time.Millisecond)
+	metricRun(job, RunResultFailed, 2*time.Second)
+	metricExited(job, 2)
+
+	server := httptest.NewServer(newHTTPHandler())
+	defer server.Close()
+	res, err := http.Get(server.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("status %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	text := string(body)
+	for _, line := range []string{
+		`# TYPE taskeeper_command_restarts_total counter`,
+		`taskeeper_command_up{name="web",group="front"} 0`,
+		`taskeeper_command_state{name="web",group="front",state="stopped"} 1`,
+		`taskeeper_command_state{name="job",group="",state="idle"} 1`,
+		`taskeeper_command_restarts_total{name="web",group="front"} 2`,
+		`taskeeper_command_broken_total{name="web",group="front"} 1`,
+		`taskeeper_command_last_exit_code{name="web",group="front"} 1`,
+		`taskeeper_command_last_exit_code{name="job",group=""} 2`,
+		`taskeeper_cron_runs_total{name="job",group="",result="success"} 1`,
+		`taskeeper_cron_runs_total{name="job",group="",result="failed"} 1`,
+		`taskeeper_cron_runs_total{name="job",group="",result="timeout"} 0`,
+		`taskeeper_cron_run_duration_seconds_bucket{name="job",group="",le="0.1"} 0`,
+		`taskeeper_cron_run_duration_seconds_bucket{name="job",group="",le="0.5"} 1`,
+		`taskeeper_cron_run_duration_seconds_bucket{name="job",group="",le="5"} 2`,
+		`taskeeper_cron_run_duration_seconds_bucket{name="job",group="",le="+Inf"} 2`,
+		`taskeeper_cron_run_duration_seconds_sum{name="job",group=""} 2.2`,
+		`taskeeper_cron_run_duration_seconds_count{name="job",group=""} 2`,
+		`taskeeper_reloads_total `,
+		`taskeeper_uptime_seconds `,
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("missing %q", line)
+		}
+	}
+	//常驻命令没有执行过 不输出执行指标
+	if strings.Contains(text, `taskeeper_cron_runs_total{name="web"`) {
+		t.Errorf("unexpected cron metrics for daemon command")
+	}
+
+	//配置了token时需要认证
+	defer setTestTokens("admin-token", "read-token")()
+	res, err = http.Get(server.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status without token %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,273 @@
+package taskeeper
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	streamStdout = "stdout" //标准输出
+	streamStderr = "stderr" //错误输出
+
+	//DefaultLineTimeFormat 前缀中 {time} 的默认时间格式
+	DefaultLineTimeFormat = time.RFC3339
+	//按行处理时单行的最大长度 超过后拆分为多行
+	maxLineSize = 64 * 1024
+	//等待写入的行队列长度 队列满时丢弃新的行 保证子进程不被阻塞
+	lineQueueSize = 1024
+)
+
+//outputPipe 子进程输出的管道 keeper从读取端复制到目标位置
+type outputPipe struct {
+	reader *os.File
+	dst    io.Writer
+	stream string        //输出来源 stdout|stderr
+	lines  bool          //是否按行处理
+	prefix func() string //按行处理时每行的前缀 为nil时原样复制
+	syslog *syslogWriter //输出到syslog时的写入端 进程结束后关闭连接
+}
+
+//将管道中的内容复制到目标位置 直到子进程关闭管道
+func (p outputPipe) copy() {
+	if p.syslog != nil {
+		defer p.syslog.Close()
+	}
+	if p.prefix != nil {
+		pumpLines(p.reader, p.dst, p.prefix)
+		return
+	}
+	defer p.reader.Close()
+	if _, err := io.Copy(p.dst, p.reader); err != nil {
+		log.Println("output copy error : " + err.Error())
+	}
+}
+
+//当前配置中可能使用切割文件的路径 包括keeper日志和所有命令的输出
+func rotatePaths() map[string]bool {
+	paths := map[string]bool{logPath: true}
+	all, _ := currentCmds()
+	for _, c := range all {
+		paths[c.Stdout()] = true
+		paths[c.Stderr()] = true
+	}
+	return paths
+}
+
+//打开一个输出位置 返回交给子进程的文件
+//需要keeper处理输出时返回管道的写入端 同时返回需要复制的管道
+func (c *Command) openOutput(path, stream string) (*os.File, *outputPipe) {
+	if c.usePipe(path) {
+		reader, writer, err := os.Pipe()
+		if err == nil {
+			p := &outputPipe{reader: reader, stream: stream}
+			//syslog按行发送消息 需要按行处理
+			p.lines = c.linePrefix != "" || isSyslogPath(path)
+			if isSyslogPath(path) {
+				p.syslog = newSyslogWriter(syslogTag(path, c.Name()), "", streamSeverity(stream))
+			}
+			p.dst = c.outputWriter(path, p.syslog)
+			return writer, p
+		}
+		log.Println(c.cmd + " output pipe error : " + err.Error())
+	}
+	if path == "" || isSyslogPath(path) {
+		return os.Stdout, nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		return os.Stdout, nil
+	}
+	return file, nil
+}
+
+//输出是否需要经过keeper的管道
+func (c *Command) usePipe(path string) bool {
+	if c.outputRing != nil {
+		return true
+	}
+	if path == os.DevNull {
+		return false
+	}
+	if c.linePrefix != "" || isSyslogPath(path) {
+		return true
+	}
+	return c.rotate.enabled() && path != ""
+}
+
+//管道输出的目标位置
+//为空时按行处理写入keeper的日志 否则写入keeper的标准输出
+//输出到syslog时写入syslog
+//其他路径由keeper打开 开启切割时按配置切割 开启缓存时同时写入缓存
+func (c *Command) outputWriter(path string, sw *syslogWriter) io.Writer {
+	var dst io.Writer
+	switch {
+	case sw != nil:
+		dst = sw
+	case path == os.DevNull:
+		dst = ioutil.Discard
+	case path == "" && c.linePrefix != "":
+		dst = keeperLogWriter{}
+	case path == "":
+		dst = os.Stdout
+	default:
+		dst = getRotateWriter(path, c.rotate)
+	}
+	if c.outputRing != nil {
+		return io.MultiWriter(dst, c.outputRing)
+	}
+	return dst
+}
+
+//生成每行前缀的方法
+//除 {time} 外的占位符在进程启动后确定
+func (c *Command) prefixFunc(stream string) func() string {
+	prefix := strings.NewReplacer(
+		"{name}", c.Name(),
+		"{id}", c.ID(),
+		"{stream}", stream,
+		"{pid}", strconv.Itoa(c.Pid()),
+	).Replace(c.linePrefix)
+	timeFormat := c.timeFormat
+	if timeFormat == "" {
+		timeFormat = DefaultLineTimeFormat
+	}
+	if !strings.Contains(prefix, "{time}") {
+		return func() string { return prefix }
+	}
+	return func() string {
+		return strings.Replace(prefix, "{time}", time.Now().UTC().Format(timeFormat), -1)
+	}
+}
+
+//keeperLogWriter 将子进程的输出写入keeper当前的日志位置
+type keeperLogWriter struct{}
+
+//Write 写入keeper的日志
+func (keeperLogWriter) Write(p []byte) (int, error) {
+	return log.Writer().Write(p)
+}
+
+//按行读取子进程输出 加上前缀后写入目标位置
+//读取和写入在不同的协程 写入过慢时丢弃新的行并记录丢弃数量
+func pumpLines(r io.ReadCloser, dst io.Writer, prefix func() string) {
+	queue := make(chan []byte, lineQueueSize)
+	var dropped int64
+	writeDropped := func() {
+		if n := atomic.SwapInt64(&dropped, 0); n > 0 {
+			dst.Write([]byte(prefix() + "[taskeeper] " + strconv.FormatInt(n, 10) + " lines dropped\n"))
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for line := range queue {
+			writeDropped()
+			if _, err := dst.Write(line); err != nil {
+				log.Println("output write error : " + err.Error())
+			}
+		}
+		writeDropped()
+	}()
+
+	br := bufio.NewReaderSize(r, maxLineSize)
+	for {
+		//超长的行会返回 bufio.ErrBufferFull 按单独一行处理
+		data, err := br.ReadSlice('\n')
+		if len(data) > 0 {
+			p := prefix()
+			line := make([]byte, 0, len(p)+len(data)+1)
+			line = append(line, p...)
+			line = append(line, data...)
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			select {
+			case queue <- line:
+			default:
+				atomic.AddInt64(&dropped, 1)
+			}
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			if err != io.EOF {
+				log.Println("output read error : " + err.Error())
+			}
+			break
+		}
+	}
+	r.Close()
+	close(queue)
+	<-done
+}
+
+//ringBuffer 固定大小的环形缓存 只保留最后写入的内容
+type ringBuffer struct {
+	lock sync.Mutex
+	buf  []byte
+	pos  int  //下一次写入的位置
+	full bool //是否已经写满过一轮
+}
+
+//创建一个环形缓存 size<=0时返回nil
+func newRingBuffer(size int) *ringBuffer {
+	if size <= 0 {
+		return nil
+	}
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+//Write 写入内容 超出容量时覆盖最早的内容
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := len(p)
+	if n >= len(r.buf) {
+		copy(r.buf, p[n-len(r.buf):])
+		r.pos = 0
+		r.full = true
+		return n, nil
+	}
+	copied := copy(r.buf[r.pos:], p)
+	if copied < n {
+		copy(r.buf, p[copied:])
+		r.full = true
+	}
+	r.pos = (r.pos + n) % len(r.buf)
+	if r.pos == 0 {
+		r.full = true
+	}
+	return n, nil
+}
+
+//Bytes 按写入顺序返回缓存的内容
+func (r *ringBuffer) Bytes() []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]byte(nil), r.buf[:r.pos]...)
+	}
+	data := make([]byte, 0, len(r.buf))
+	data = append(data, r.buf[r.pos:]...)
+	return append(data, r.buf[:r.pos]...)
+}
+
+//Tail 返回缓存中最后不超过n字节的完整行
+func (r *ringBuffer) Tail(n int) []byte {
+	data := r.Bytes()
+	if len(data) <= n {
+		return data
+	}
+	data = data[len(data)-n:]
+	if idx := bytes.IndexByte(data, '\n'); idx >= 0 && idx < len(data)-1 {
+		data = data[idx+1:]
+	}
+	return data
+}
@@ -0,0 +1,84 @@
+package taskeeper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPumpLines(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var buf bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		pumpLines(r, &buf, func() string { return "[test:stdout] " })
+		close(done)
+	}()
+	w.Write([]byte("hello "))
+	w.Write([]byte("world\nsecond"))
+	w.Write([]byte(strings.Repeat("x", maxLineSize+10)))
+	w.Close()
+	<-done
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("line count %d", len(lines))
+	}
+	if lines[0] != "[test:stdout] hello world" {
+		t.Fatalf("first line %q", lines[0])
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "[test:stdout] ") {
+			t.Fatalf("line without prefix %q", line[:20])
+		}
+	}
+}
+
+func TestCmdLinePrefix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("need /bin/sh")
+	}
+	dir, err := ioutil.TempDir("", "taskeeper-prefix")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	out := dir + "/out.log"
+	cmd := NewCommand("/bin/sh", []string{"-c", "echo out; echo err >&2"}, out)
+	cmd.SetName("echo").SetLinePrefix("[{name}:{stream}] ", "")
+	if cmd.Start() <= 0 {
+		t.Fatal("start failed")
+	}
+	cmd.Wait()
+
+	data, _ := ioutil.ReadFile(out)
+	if !strings.Contains(string(data), "[echo:stdout] out\n") || !strings.Contains(string(data), "[echo:stderr] err\n") {
+		t.Fatalf("prefixed output %q", data)
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	r := newRingBuffer(16)
+	r.Write([]byte("first line\n"))
+	if string(r.Bytes()) != "first line\n" {
+		t.Fatalf("ring content %q", r.Bytes())
+	}
+	r.Write([]byte("second\nthird\n"))
+	if string(r.Bytes()) != "ne\nsecond\nthird\n" {
+		t.Fatalf("ring content %q", r.Bytes())
+	}
+	if string(r.Tail(10)) != "third\n" {
+		t.Fatalf("ring tail %q", r.Tail(10))
+	}
+	r.Write([]byte(strings.Repeat("x", 40)))
+	if string(r.Bytes()) != strings.Repeat("x", 16) {
+		t.Fatalf("ring overflow %q", r.Bytes())
+	}
+}
@@ -0,0 +1,25 @@
+//go:build linux
+// +build linux
+
+package taskeeper
+
+import (
+	"net"
+	"syscall"
+)
+
+//通过SO_PEERCRED获取unix socket客户端的进程信息
+func unixPeerCred(c *net.UnixConn) *PeerCred {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var cred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if cerr != nil || err != nil || cred == nil {
+		return nil
+	}
+	return &PeerCred{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package taskeeper
+
+import "net"
+
+//其他系统暂不获取unix socket客户端的进程信息
+func unixPeerCred(c *net.UnixConn) *PeerCred {
+	return nil
+}
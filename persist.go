@@ -0,0 +1,261 @@
+package taskeeper
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//最多保留的重载时间
+const maxReloadTimes = 100
+
+//频繁变化的状态先在内存中标记 按该间隔写入状态文件
+const stateFlushInterval = 5 * time.Second
+
+//KeeperState 需要在keeper重启后保留的运行状态
+//命令的id每次启动随机生成 因此使用命令名称作为key
+type KeeperState struct {
+	CronFires   map[string]int64     `json:"cron_fires"`   //cron命令最后一次触发的时间
+	Paused      map[string]bool      `json:"paused"`       //通过控制命令暂停的命令
+	Crashes     map[string]int       `json:"crashes"`      //常驻命令异常退出的累计次数
+	LastExits   map[string]*ExitInfo `json:"last_exits"`   //命令最后一次退出的信息
+	ReloadTimes []int64              `json:"reload_times"` //重载配置的时间
+}
+
+//ExitInfo 命令最后一次退出的信息
+type ExitInfo struct {
+	Code int    `json:"code"` //退出码 启动失败或被信号杀死时为-1
+	Pid  int    `json:"pid"`  //进程pid
+	Time string `json:"time"` //退出时间
+}
+
+var (
+	//IgnoreState 启动时忽略状态文件 从空状态开始 之后的状态仍然会写入
+	IgnoreState bool
+	//keeperState 当前的持久化状态
+	keeperState = newKeeperState()
+	//stateLock 持久化状态的读写锁
+	stateLock sync.Mutex
+	//stateDirty 持久化状态有未写入文件的变化
+	stateDirty bool
+)
+
+//创建一个空的持久化状态
+func newKeeperState() *KeeperState {
+	return &KeeperState{
+		CronFires: make(map[string]int64),
+		Paused:    make(map[string]bool),
+		Crashes:   make(map[string]int),
+		LastExits: make(map[string]*ExitInfo),
+	}
+}
+
+//从状态文件读取持久化状态 恢复重载时间
+//文件不存在或者设置了IgnoreState时使用空状态
+func loadKeeperState() error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	keeperState = newKeeperState()
+	if IgnoreState {
+		log.Println("state file ignored : " + statePath)
+		return nil
+	}
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		log.Println("state load file error : " + err.Error())
+		return err
+	}
+	st := newKeeperState()
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		log.Println("state load decode error : " + err.Error())
+		return err
+	}
+	if st.CronFires == nil {
+		st.CronFires = make(map[string]int64)
+	}
+	if st.Paused == nil {
+		st.Paused = make(map[string]bool)
+	}
+	if st.Crashes == nil {
+		st.Crashes = make(map[string]int)
+	}
+	if st.LastExits == nil {
+		st.LastExits = make(map[string]*ExitInfo)
+	}
+	keeperState = st
+	ReloadTime = append([]int64(nil), st.ReloadTimes...)
+	return nil
+}
+
+//按持久化状态设置命令的暂停标记 启动和重载配置后调用
+func restorePaused() {
+	all, _ := currentCmds()
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	for _, cmd := range all {
+		if keeperState.Paused[cmd.Name()] {
+			cmd.SetPause()
+			log.Println("state restored paused cmd : " + cmd.Name())
+		}
+	}
+}
+
+//将持久化状态写入状态文件
+//先写入临时文件再重命名 保证文件内容完整
+func saveKeeperState() error {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	stateDirty = false
+	data, err := json.Marshal(keeperState)
+	if err != nil {
+		log.Println("state save encode error : " + err.Error())
+		return err
+	}
+	tmpPath := statePath + ".tmp"
+	err = writeSyncFile(tmpPath, data)
+	if err != nil {
+		log.Println("state save write error : " + err.Error())
+		return err
+	}
+	err = os.Rename(tmpPath, statePath)
+	if err != nil {
+		log.Println("state save rename error : " + err.Error())
+		return err
+	}
+	return nil
+}
+
+//标记持久化状态有变化 由定时任务写入状态文件
+//cron触发 进程退出等频繁变化的状态使用 避免每次变化都落盘
+func markKeeperState() {
+	stateLock.Lock()
+	stateDirty = true
+	stateLock.Unlock()
+}
+
+//有未写入的变化时写入状态文件
+func flushKeeperState() {
+	stateLock.Lock()
+	dirty := stateDirty
+	stateLock.Unlock()
+	if dirty {
+		saveKeeperState()
+	}
+}
+
+//定时写入有变化的持久化状态 Run退出时写入最后的状态
+func syncKeeperState() {
+	runRoutines.Add(1)
+	go func() {
+		defer runRoutines.Done()
+		for {
+			select {
+			case <-runStop:
+				flushKeeperState()
+				return
+			case <-time.After(stateFlushInterval):
+				flushKeeperState()
+			}
+		}
+	}()
+}
+
+//写入文件并落盘 重命名之前保证内容已经写入磁盘
+func writeSyncFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//获取cron命令最后一次触发的时间
+func getCronFire(name string) (int64, bool) {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	ts, ok := keeperState.CronFires[name]
+	return ts, ok
+}
+
+//记录cron命令触发的时间 定时写入状态文件
+func setCronFire(name string, ts int64) {
+	stateLock.Lock()
+	keeperState.CronFires[name] = ts
+	stateLock.Unlock()
+	markKeeperState()
+}
+
+//记录命令的暂停标记 并写入状态文件
+func setCmdPaused(name string, paused bool) {
+	stateLock.Lock()
+	if paused {
+		keeperState.Paused[name] = true
+	} else {
+		delete(keeperState.Paused, name)
+	}
+	stateLock.Unlock()
+	saveKeeperState()
+}
+
+//常驻命令异常退出的累计次数
+func getCrashes(name string) int {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return keeperState.Crashes[name]
+}
+
+//常驻命令异常退出次数+1 定时写入状态文件
+func addCrash(name string) {
+	stateLock.Lock()
+	keeperState.Crashes[name]++
+	stateLock.Unlock()
+	markKeeperState()
+}
+
+//获取命令最后一次退出的信息
+func getLastExit(name string) *ExitInfo {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return keeperState.LastExits[name]
+}
+
+//记录命令退出的信息 定时写入状态文件
+func setLastExit(name string, pid, code int) {
+	stateLock.Lock()
+	keeperState.LastExits[name] = &ExitInfo{Code: code, Pid: pid, Time: formatDate(time.Now().Unix())}
+	stateLock.Unlock()
+	markKeeperState()
+}
+
+//记录重载配置的时间 并写入状态文件
+func addReloadTime(ts int64) {
+	stateLock.Lock()
+	ReloadTime = append(ReloadTime, ts)
+	if len(ReloadTime) > maxReloadTimes {
+		ReloadTime = ReloadTime[len(ReloadTime)-maxReloadTimes:]
+	}
+	keeperState.ReloadTimes = append([]int64(nil), ReloadTime...)
+	stateLock.Unlock()
+	saveKeeperState()
+}
+
+//获取重载配置的时间列表
+func reloadTimes() []int64 {
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	return append([]int64(nil), ReloadTime...)
+}
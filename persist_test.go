@@ -0,0 +1,173 @@
+package taskeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeeperState(t *testing.T) {
+	oldPath := statePath
+	statePath = filepath.Join(t.TempDir(), "taskeeper.state")
+	defer func() {
+		statePath = oldPath
+	}()
+
+	setCronFire("billing", 1500000000)
+	//cron触发时间只标记变化 写入后才能读取
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Error("state file written on every cron fire")
+	}
+	flushKeeperState()
+	keeperState = newKeeperState()
+	if err := loadKeeperState(); err != nil {
+		t.Fatal(err.Error())
+	}
+	ts, ok := getCronFire("billing")
+	if !ok || ts != 1500000000 {
+		t.Fatalf("cron fire time not restored : %d %v", ts, ok)
+	}
+}
+
+func TestKeeperStateRestore(t *testing.T) {
+	oldPath, oldCmds, oldReload := statePath, cmds, ReloadTime
+	statePath = filepath.Join(t.TempDir(), "taskeeper.state")
+	defer func() {
+		statePath, cmds, ReloadTime, IgnoreState = oldPath, oldCmds, oldReload, false
+		keeperState = newKeeperState()
+	}()
+	keeperState = newKeeperState()
+	ReloadTime = nil
+
+	setCmdPaused("web", true)
+	setCmdPaused("db", true)
+	setCmdPaused("db", false)
+	addCrash("web")
+	addCrash("web")
+	setLastExit("web", 1234, 2)
+	addReloadTime(1600000000)
+	flushKeeperState()
+	if _, err := os.Stat(statePath + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temp state file left")
+	}
+
+	//模拟keeper重启
+	web := NewCommand("/bin/true", nil, "").SetName("web")
+	db := NewCommand("/bin/true", nil, "").SetName("db")
+	cmds = map[string]*Command{"webid": web, "dbid": db}
+	keeperState, ReloadTime = newKeeperState(), nil
+	if err := loadKeeperState(); err != nil {
+		t.Fatal(err.Error())
+	}
+	restorePaused()
+	if !web.IsPause() || db.IsPause() {
+		t.Errorf("paused web %v db %v", web.IsPause(), db.IsPause())
+	}
+	if n := getCrashes("web"); n != 2 {
+		t.Errorf("crashes %d", n)
+	}
+	if e := getLastExit("web"); e == nil || e.Code != 2 || e.Pid != 1234 || e.Time == "" {
+		t.Errorf("last exit %+v", e)
+	}
+	if len(ReloadTime) != 1 || ReloadTime[0] != 1600000000 {
+		t.Errorf("reload times %v", ReloadTime)
+	}
+
+	//忽略状态文件时从空状态开始
+	IgnoreState = true
+	web.SetRun()
+	ReloadTime = nil
+	if err := loadKeeperState(); err != nil {
+		t.Fatal(err.Error())
+	}
+	restorePaused()
+	if web.IsPause() || getCrashes("web") != 0 || getLastExit("web") != nil || len(ReloadTime) != 0 {
+		t.Error("state restored with IgnoreState")
+	}
+}
+
+func TestMissedCronTimes(t *testing.T) {
+	cmd := NewCommand("/bin/true", nil, "").SetCron("*/10 * * * *")
+	now := time.Date(2020, 5, 11, 10, 35, 20, 0, time.Local)
+	last := time.Date(2020, 5, 11, 10, 0, 5, 0, time.Local)
+
+	missed := missedCronTimes(cmd, last, now)
+	if len(missed) != 3 {
+		t.Fatalf("missed runs %v", missed)
+	}
+	if missed[len(missed)-1].Minute() != 30 {
+		t.Fatalf("latest missed run %v", missed[len(missed)-1])
+	}
+
+	cmd.SetCatchUp(CatchUpAll, 15*time.Minute)
+	missed = missedCronTimes(cmd, last, now)
+	if len(missed) != 1 {
+		t.Fatalf("missed runs in deadline %v", missed)
+	}
+}
+
+func TestCatchUpCron(t *testing.T) {
+	useTempRunDir(t)
+	keeperState = newKeeperState()
+	defer func() {
+		keeperState = newKeeperState()
+	}()
+	dir := t.TempDir()
+
+	//秒级cron错过一小时 每次执行在文件中追加一行
+	newJob := func(name, policy string) (*Command, string) {
+		out := filepath.Join(dir, name)
+		cmd := NewCommand("/bin/sh", []string{"-c", "echo x >> " + out}, os.DevNull).SetName(name).SetCron("* * * * * * *")
+		cmd.SetID(name)
+		cmd.SetCatchUp(policy, 0)
+		setCronFire(name, time.Now().Add(-time.Hour).Unix())
+		return cmd, out
+	}
+	waitRuns := func(out string, want int) {
+		n := 0
+		for i := 0; i < 1000; i++ {
+			data, _ := ioutil.ReadFile(out)
+			if n = strings.Count(string(data), "\n"); n >= want {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		if n != want {
+			t.Errorf("%s ran %d times, want %d", filepath.Base(out), n, want)
+		}
+	}
+
+	//none 不补偿 触发时间不变
+	cmd, _ := newJob("skip", CatchUpNone)
+	last, _ := getCronFire("skip")
+	catchUpCron(cmd)
+	if ts, _ := getCronFire("skip"); ts != last || len(cmd.Runs()) != 0 {
+		t.Errorf("none policy ran %d times, fire time %d -> %d", len(cmd.Runs()), last, ts)
+	}
+
+	//latest 只补偿最近的一次
+	cmd, out := newJob("once", CatchUpLatest)
+	before := time.Now().Unix()
+	catchUpCron(cmd)
+	if ts, _ := getCronFire("once"); ts < before-1 {
+		t.Errorf("latest policy fire time %d", ts)
+	}
+	waitRuns(out, 1)
+
+	//all 依次补偿 最多maxCatchUpRuns次
+	cmd, out = newJob("all", CatchUpAll)
+	catchUpCron(cmd)
+	waitRuns(out, maxCatchUpRuns)
+
+	//没有触发记录时不补偿 以当前时间作为起点
+	cmd = NewCommand("/bin/true", nil, "").SetName("fresh").SetCron("* * * * * * *")
+	cmd.SetCatchUp(CatchUpAll, 0)
+	before = time.Now().Unix()
+	catchUpCron(cmd)
+	if ts, ok := getCronFire("fresh"); !ok || ts < before || len(cmd.Runs()) != 0 {
+		t.Errorf("first start fire time %d %v", ts, ok)
+	}
+}
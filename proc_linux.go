@@ -0,0 +1,139 @@
+//go:build linux
+// +build linux
+
+package taskeeper
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//procRoot proc文件系统的位置
+var procRoot = "/proc"
+
+//读取所有进程的信息 按pid保存
+func readProcs() (map[int]*procInfo, bool) {
+	dir, err := os.Open(procRoot)
+	if err != nil {
+		return nil, false
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, false
+	}
+	boot := bootTime()
+	procs := make(map[int]*procInfo, len(names))
+	for _, name := range names {
+		pid, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		if p, ok := readProcStat(pid, boot); ok {
+			procs[pid] = p
+		}
+	}
+	return procs, true
+}
+
+//解析 /proc/{pid}/stat
+func readProcStat(pid int, boot int64) (*procInfo, bool) {
+	data, err := ioutil.ReadFile(procRoot + "/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return nil, false
+	}
+	//进程名称中可能包含空格和括号 从最后一个括号之后开始解析
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return nil, false
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22 {
+		return nil, false
+	}
+	num := func(i int) uint64 {
+		n, _ := strconv.ParseUint(fields[i], 10, 64)
+		return n
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	threads, _ := strconv.Atoi(fields[17])
+	startTicks := num(19)
+	return &procInfo{
+		ppid:    ppid,
+		ticks:   num(11) + num(12),
+		threads: threads,
+		vms:     num(20),
+		rss:     num(21) * uint64(os.Getpagesize()),
+		start:   time.Unix(boot+int64(startTicks/clockTicks), 0),
+	}, true
+}
+
+//进程打开的文件描述符数 没有权限时为0
+func countFDs(pid int) int {
+	dir, err := os.Open(procRoot + "/" + strconv.Itoa(pid) + "/fd")
+	if err != nil {
+		return 0
+	}
+	defer dir.Close()
+	names, _ := dir.Readdirnames(-1)
+	return len(names)
+}
+
+//系统启动的时间 读取 /proc/stat 中的btime
+func bootTime() int64 {
+	f, err := os.Open(procRoot + "/stat")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "btime ") {
+			t, _ := strconv.ParseInt(strings.TrimSpace(line[6:]), 10, 64)
+			return t
+		}
+	}
+	return 0
+}
+
+//proc limits文件中的名称对应的资源限制
+var procLimitNames = map[string]string{
+	"Max cpu time":       "cpu",
+	"Max stack size":     "stack",
+	"Max core file size": "core",
+	"Max processes":      "nproc",
+	"Max open files":     "nofile",
+	"Max address space":  "as",
+}
+
+//读取进程实际生效的资源限制 /proc/{pid}/limits
+func readProcLimits(pid int) map[string]Rlimit {
+	data, err := ioutil.ReadFile(procRoot + "/" + strconv.Itoa(pid) + "/limits")
+	if err != nil {
+		return nil
+	}
+	limits := make(map[string]Rlimit)
+	for _, line := range strings.Split(string(data), "\n") {
+		for prefix, name := range procLimitNames {
+			if !strings.HasPrefix(line, prefix+"  ") {
+				continue
+			}
+			fields := strings.Fields(line[len(prefix):])
+			if len(fields) < 2 {
+				continue
+			}
+			soft, err1 := parseLimitValue("", fields[0])
+			hard, err2 := parseLimitValue("", fields[1])
+			if err1 == nil && err2 == nil {
+				limits[name] = Rlimit{Soft: soft, Hard: hard}
+			}
+		}
+	}
+	return limits
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package taskeeper
+
+//其他系统暂不支持读取进程的资源使用
+func readProcs() (map[int]*procInfo, bool) {
+	return nil, false
+}
+
+//其他系统暂不支持读取进程的文件描述符数
+func countFDs(pid int) int {
+	return 0
+}
+
+//其他系统暂不支持读取进程实际生效的资源限制
+func readProcLimits(pid int) map[string]Rlimit {
+	return nil
+}
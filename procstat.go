@@ -0,0 +1,159 @@
+package taskeeper
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+//DefaultProcInterval 默认的进程资源采样间隔
+const DefaultProcInterval = 5 * time.Second
+
+//每秒的cpu时钟数 linux下USER_HZ通常为100
+const clockTicks = 100
+
+//procInterval 进程资源的采样间隔 配置项 resource_interval
+var procInterval = DefaultProcInterval
+
+//procInfo 从系统读取的单个进程信息
+type procInfo struct {
+	ppid    int       //父进程pid
+	ticks   uint64    //用户态和内核态的cpu时钟数
+	rss     uint64    //常驻内存 字节
+	vms     uint64    //虚拟内存 字节
+	threads int       //线程数
+	start   time.Time //进程启动时间
+}
+
+//ProcUsage 命令进程树的资源使用 包含所有子孙进程
+type ProcUsage struct {
+	CPUPercent float64 `json:"cpu_percent"` //距上次采样的cpu使用率 100为一个核心
+	RSS        uint64  `json:"rss_bytes"`   //常驻内存
+	VMS        uint64  `json:"vms_bytes"`   //虚拟内存
+	FDs        int     `json:"fds"`         //打开的文件描述符数
+	Threads    int     `json:"threads"`     //线程数
+	Procs      int     `json:"procs"`       //进程数
+	StartTime  string  `json:"start_time"`  //命令进程的启动时间
+
+	Cgroup *CgroupUsage `json:"cgroup,omitempty"` //命令cgroup的资源使用
+}
+
+var (
+	//procLock 采样结果的锁
+	procLock sync.Mutex
+	//procUsages 最近一次采样的结果 按命令id保存
+	procUsages map[string]*ProcUsage
+	//procTicks 最近一次采样时每个进程的cpu时钟数
+	procTicks map[int]uint64
+	//procSampleAt 最近一次采样的时间
+	procSampleAt time.Time
+)
+
+//启动进程资源的采样协程 系统不支持时不启动
+func startProcSampler() {
+	if _, ok := readProcs(); !ok {
+		log.Println("process resource usage is not supported on this system")
+		return
+	}
+	runRoutines.Add(1)
+	go func() {
+		defer runRoutines.Done()
+		for {
+			sampleProcs()
+			select {
+			case <-runStop:
+				return
+			case <-time.After(procInterval):
+			}
+		}
+	}()
+}
+
+//采样所有运行中命令的进程树
+func sampleProcs() {
+	procs, ok := readProcs()
+	if !ok {
+		return
+	}
+	children := make(map[int][]int)
+	for pid, p := range procs {
+		children[p.ppid] = append(children[p.ppid], pid)
+	}
+
+	running := make(map[string]*Command)
+	all, _ := currentCmds()
+	for id, c := range all {
+		if c.Pid() > 0 {
+			running[id] = c
+		}
+	}
+
+	now := time.Now()
+	procLock.Lock()
+	prev, elapsed := procTicks, now.Sub(procSampleAt).Seconds()
+	procLock.Unlock()
+
+	ticks := make(map[int]uint64)
+	usages := make(map[string]*ProcUsage, len(running))
+	for id, c := range running {
+		if u := treeUsage(c.Pid(), procs, children, prev, ticks, elapsed); u != nil {
+			if dir := c.currentCgroup(); dir != "" {
+				u.Cgroup = readCgroupUsage(dir)
+			}
+			usages[id] = u
+		}
+	}
+
+	procLock.Lock()
+	procUsages, procTicks, procSampleAt = usages, ticks, now
+	procLock.Unlock()
+
+	for id, u := range usages {
+		checkWatchdog(running[id], u, now)
+	}
+}
+
+//汇总进程树的资源使用 记录本次每个进程的cpu时钟数
+//上次采样中没有的进程不计算cpu使用率
+func treeUsage(root int, procs map[int]*procInfo, children map[int][]int, prev, ticks map[int]uint64, elapsed float64) *ProcUsage {
+	rp, ok := procs[root]
+	if !ok {
+		return nil
+	}
+	u := &ProcUsage{StartTime: formatDate(rp.start.Unix())}
+	var delta uint64
+	stack := []int{root}
+	for len(stack) > 0 {
+		pid := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		p, ok := procs[pid]
+		if !ok {
+			continue
+		}
+		u.Procs++
+		u.RSS += p.rss
+		u.VMS += p.vms
+		u.Threads += p.threads
+		u.FDs += countFDs(pid)
+		ticks[pid] = p.ticks
+		if last, ok := prev[pid]; ok && p.ticks >= last {
+			delta += p.ticks - last
+		}
+		stack = append(stack, children[pid]...)
+	}
+	if prev != nil && elapsed > 0 {
+		u.CPUPercent = math.Round(float64(delta)/clockTicks/elapsed*10000) / 100
+	}
+	return u
+}
+
+//命令最近一次采样的资源使用 命令未运行或没有采样时返回nil
+func cmdUsage(c *Command) *ProcUsage {
+	if c.Pid() <= 0 {
+		return nil
+	}
+	procLock.Lock()
+	defer procLock.Unlock()
+	return procUsages[c.ID()]
+}
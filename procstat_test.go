@@ -0,0 +1,53 @@
+package taskeeper
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestProcUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process usage only on linux")
+	}
+	//当前进程和一个子进程组成进程树
+	child := exec.Command("sleep", "5")
+	if err := child.Start(); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer child.Wait()
+	defer child.Process.Kill()
+
+	procs, ok := readProcs()
+	if !ok {
+		t.Fatal("read procs failed")
+	}
+	if p := procs[child.Process.Pid]; p == nil || p.ppid != os.Getpid() {
+		t.Fatalf("child proc %+v", p)
+	}
+	children := make(map[int][]int)
+	for pid, p := range procs {
+		children[p.ppid] = append(children[p.ppid], pid)
+	}
+	ticks := make(map[int]uint64)
+	u := treeUsage(os.Getpid(), procs, children, nil, ticks, 0)
+	if u == nil || u.Procs < 2 || u.RSS == 0 || u.VMS == 0 || u.Threads < 2 || u.FDs == 0 || u.CPUPercent != 0 {
+		t.Fatalf("usage %+v", u)
+	}
+	if _, ok := ticks[child.Process.Pid]; !ok {
+		t.Errorf("child ticks not recorded")
+	}
+	start, err := time.ParseInLocation("2006-01-02 15:04:05", u.StartTime, time.Local)
+	if err != nil || time.Since(start) < 0 || time.Since(start) > time.Hour {
+		t.Errorf("start time %s", u.StartTime)
+	}
+
+	//第二次采样按时钟数的差值计算cpu使用率
+	prev := map[int]uint64{os.Getpid(): 0}
+	u = treeUsage(os.Getpid(), procs, children, prev, make(map[int]uint64), 1)
+	if u.CPUPercent != float64(procs[os.Getpid()].ticks) {
+		t.Errorf("cpu percent %v, ticks %d", u.CPUPercent, procs[os.Getpid()].ticks)
+	}
+}
@@ -0,0 +1,251 @@
+package taskeeper
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ProtocolVersion json控制协议的版本
+//请求和响应都是一行json 以换行结束
+//请求 `{"v":1,"id":1,"method":"command","params":{"name":"test"}}`
+//响应 `{"v":1,"id":1,"result":{...}}` 失败时 `{"v":1,"id":1,"error":{"code":9,"message":"..."}}`
+const ProtocolVersion = 1
+
+//json协议支持的方法
+const (
+	MethodStatus   = "status"   //keeper的运行状态
+	MethodCommands = "commands" //所有命令的状态
+	MethodCommand  = "command"  //单个命令的状态 需要name
+	MethodOutput   = "output"   //命令最近的输出 需要name
+	MethodConfig   = "config"   //keeper的配置
+	MethodAudit    = "audit"    //最近的审计日志 lines指定条数
+	//MethodSubscribe 订阅事件 保持连接 成功响应后每个事件推送一行json
+	//name或group只接收对应命令的事件 没有命令的keeper事件总是推送
+	MethodSubscribe = "subscribe"
+	MethodStart     = "start"    //启动命令 没有name时启动所有命令
+	MethodStop      = "stop"     //停止命令 需要name
+	MethodRestart   = "restart"  //重启命令 需要name
+	MethodPause     = "pause"    //暂停命令 没有name时暂停所有命令
+	MethodExec      = "exec"     //单次执行命令 需要name
+	MethodReload    = "reload"   //重新加载配置
+	MethodShutdown  = "shutdown" //keeper退出
+)
+
+//Request json协议的请求
+type Request struct {
+	V      int           `json:"v"`                //协议版本
+	ID     uint64        `json:"id"`               //请求id 响应中原样返回
+	Method string        `json:"method"`           //方法
+	Params RequestParams `json:"params,omitempty"` //参数
+	Token  string        `json:"token,omitempty"`  //通过tcp访问时的token
+}
+
+//RequestParams 请求的参数
+type RequestParams struct {
+	Name  string `json:"name,omitempty"`  //命令的名称或id
+	Lines int    `json:"lines,omitempty"` //返回的最大条数
+	Group string `json:"group,omitempty"` //命令的分组 用于订阅事件
+}
+
+//Response json协议的响应
+type Response struct {
+	V      int             `json:"v"`                //协议版本
+	ID     uint64          `json:"id"`               //对应的请求id
+	Result json.RawMessage `json:"result,omitempty"` //成功时的结果
+	Error  *ResponseError  `json:"error,omitempty"`  //失败时的错误
+}
+
+//ResponseError 响应中的错误 code与ErrRes系列常量对应
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+//Error 实现error接口
+func (e *ResponseError) Error() string {
+	return strconv.Itoa(e.Code) + " : " + e.Message
+}
+
+//需要指定命令的操作对应的act
+var methodActs = map[string]int{
+	MethodStart:   ActStart,
+	MethodStop:    ActExit,
+	MethodRestart: ActReload,
+	MethodPause:   ActPause,
+	MethodExec:    ActExec,
+}
+
+//不指定命令时的操作对应的信号
+var methodSignals = map[string]string{
+	MethodStart:    "start",
+	MethodPause:    "pause",
+	MethodReload:   "reload",
+	MethodShutdown: "exit",
+}
+
+//旧的文本协议 `ctl act {act} {name}` 对应的方法
+var legacyActMethods = map[int]string{
+	ActStart:  MethodStart,
+	ActExit:   MethodStop,
+	ActReload: MethodRestart,
+	ActPause:  MethodPause,
+	ActExec:   MethodExec,
+}
+
+//处理一行json请求 返回一行json响应
+func handleRequest(p *peer, line []byte) []byte {
+	var req Request
+	resp := Response{V: ProtocolVersion}
+	if err := json.Unmarshal(line, &req); err != nil {
+		resp.Error = &ResponseError{ErrResWrgMsg, ErrMsgMap[ErrResWrgMsg] + " : " + err.Error()}
+	} else if resp.ID = req.ID; req.V != ProtocolVersion {
+		resp.Error = &ResponseError{ErrResVersion, ErrMsgMap[ErrResVersion] + " : " + strconv.Itoa(req.V)}
+	} else {
+		result, errcode := dispatch(p, req.Token, req.Method, req.Params)
+		if errcode != ErrResCodeNo {
+			msg, _ := result.(string)
+			resp.Error = &ResponseError{errcode, msg}
+		} else if resp.Result, _ = json.Marshal(result); resp.Result == nil {
+			resp.Result = json.RawMessage("null")
+		}
+	}
+	data, _ := json.Marshal(resp)
+	return append(data, '\n')
+}
+
+//执行一个方法 json协议 文本协议和http使用同一个处理
+//校验客户端的权限后执行 控制操作会记录审计日志
+//返回结果和错误编号 失败时结果为错误消息
+func dispatch(p *peer, token, method string, params RequestParams) (interface{}, int) {
+	start := time.Now()
+	identity, errmsg, errcode := p.authorize(token, method, params.Name)
+	if errcode != ErrResCodeNo {
+		auditRequest(p, identity, method, params.Name, errcode, start)
+		return errmsg, errcode
+	}
+	result, errcode := execMethod(method, params, p.roleUser(token))
+	auditRequest(p, identity, method, params.Name, errcode, start)
+	return result, errcode
+}
+
+//执行方法 配置了用户时按用户的角色过滤列表中的命令
+func execMethod(method string, params RequestParams, u *rbacUser) (interface{}, int) {
+	msgProcessLock.Lock()
+	defer msgProcessLock.Unlock()
+
+	var stat []string
+	switch method {
+	case MethodStatus:
+		stat = []string{StatArgsMap[2]}
+	case MethodCommands:
+		stat = []string{StatArgsMap[1]}
+	case MethodConfig:
+		return sendStat(StatArgsMap[3])
+	case MethodAudit:
+		stat = []string{StatArgsMap[4], strconv.Itoa(params.Lines)}
+	case MethodCommand, MethodOutput:
+		if params.Name == "" {
+			return ErrMsgMap[ErrResMissCmd], ErrResMissCmd
+		}
+		if _, ok := findCmd(params.Name); !ok {
+			return ErrMsgMap[ErrResNoCmd] + " : {" + params.Name + "}", ErrResNoCmd
+		}
+		if method == MethodOutput {
+			return sendStat(StatArgsMap[0], params.Name, StatCmdOutput)
+		}
+		return sendStat(StatArgsMap[0], params.Name)
+	}
+	if stat != nil {
+		result, errcode := sendStat(stat...)
+		if errcode != ErrResCodeNo {
+			return result, errcode
+		}
+		return filterResult(u, method, result), errcode
+	}
+
+	if params.Name == "" {
+		if s, ok := methodSignals[method]; ok {
+			return sendSignal(s)
+		}
+		if _, ok := methodActs[method]; ok {
+			return ErrMsgMap[ErrResMissCmd], ErrResMissCmd
+		}
+	} else if act, ok := methodActs[method]; ok {
+		cmd, ok := findCmd(params.Name)
+		if !ok {
+			return ErrMsgMap[ErrResNoCmd] + " : {" + params.Name + "}", ErrResNoCmd
+		}
+		//单独控制时按名称查找命令
+		return sendSignal("act", strconv.Itoa(act), cmd.Name())
+	}
+	return ErrMsgMap[ErrResUdfMethod] + " : {" + method + "}", ErrResUdfMethod
+}
+
+//按名称或id查找命令
+func findCmd(name string) (*Command, bool) {
+	if name == "" {
+		return nil, false
+	}
+	id, ok := findCmdIDByName(name)
+	if !ok {
+		id, ok = findCmdID(name)
+	}
+	cmd, found := cmdByID(id)
+	return cmd, ok && found
+}
+
+//将旧的文本协议转换为方法和参数
+//`ctl reload|start|exit|pause` `ctl act {act} {name}`
+//`stat cmd {id} [output]` `stat cmdlist` `stat server` `stat config` `stat audit [n]`
+//无法转换时返回错误消息和错误编号
+func legacyMethod(typ string, args []string) (string, RequestParams, string, int) {
+	var params RequestParams
+	switch typ {
+	case MsgSigCtl:
+		if args[0] == "act" {
+			if len(args) < 3 {
+				return "", params, ErrMsgMap[ErrResCtlSig] + " : {" + args[0] + "}", ErrResCtlSig
+			}
+			act, err := strconv.Atoi(args[1])
+			method, ok := legacyActMethods[act]
+			if err != nil || !ok {
+				return "", params, ErrMsgMap[ErrResCtlSig] + " : {" + strings.Join(args, " ") + "}", ErrResCtlSig
+			}
+			params.Name = args[2]
+			return method, params, "", ErrResCodeNo
+		}
+		for method, s := range methodSignals {
+			if s == args[0] {
+				return method, params, "", ErrResCodeNo
+			}
+		}
+		return "", params, ErrMsgMap[ErrResWrgSig] + " : {" + args[0] + "}", ErrResWrgSig
+	case MsgSigStat:
+		switch args[0] {
+		case StatArgsMap[0]:
+			if len(args) < 2 {
+				return "", params, ErrMsgMap[ErrResMissCmd], ErrResMissCmd
+			}
+			params.Name = args[1]
+			if len(args) > 2 && args[2] == StatCmdOutput {
+				return MethodOutput, params, "", ErrResCodeNo
+			}
+			return MethodCommand, params, "", ErrResCodeNo
+		case StatArgsMap[1]:
+			return MethodCommands, params, "", ErrResCodeNo
+		case StatArgsMap[2]:
+			return MethodStatus, params, "", ErrResCodeNo
+		case StatArgsMap[3]:
+			return MethodConfig, params, "", ErrResCodeNo
+		case StatArgsMap[4]:
+			if len(args) > 1 {
+				params.Lines, _ = strconv.Atoi(args[1])
+			}
+			return MethodAudit, params, "", ErrResCodeNo
+		}
+		return "", params, ErrMsgMap[ErrResStatNil] + " : " + strings.Join(args, " "), ErrResStatNil
+	}
+	return "", params, ErrMsgMap[ErrResUdfCtl] + " : {" + typ + "}", ErrResUdfCtl
+}
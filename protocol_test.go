@@ -0,0 +1,79 @@
+package taskeeper
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestJSONProtocol(t *testing.T) {
+	server, conn := net.Pipe()
+	go listenHandle(server)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	call := func(req string) Response {
+		if _, err := conn.Write([]byte(req + "\n")); err != nil {
+			t.Fatal(err.Error())
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var resp Response
+		if err = json.Unmarshal(line, &resp); err != nil {
+			t.Fatalf("response %q : %s", line, err.Error())
+		}
+		return resp
+	}
+
+	resp := call(`{"v":1,"id":7,"method":"commands"}`)
+	var list []CmdStatus
+	if resp.ID != 7 || resp.Error != nil || json.Unmarshal(resp.Result, &list) != nil {
+		t.Fatalf("commands response %+v", resp)
+	}
+	//同一个连接可以继续发送请求
+	resp = call(`{"v":2,"id":8,"method":"status"}`)
+	if resp.ID != 8 || resp.Error == nil || resp.Error.Code != ErrResVersion {
+		t.Fatalf("version response %+v", resp)
+	}
+	resp = call(`{"v":1,"id":9,"method":"stop"}`)
+	if resp.Error == nil || resp.Error.Code != ErrResMissCmd {
+		t.Fatalf("stop response %+v", resp)
+	}
+	resp = call(`{"v":1,"id":10,"method":"restart","params":{"name":"none|such"}}`)
+	if resp.Error == nil || resp.Error.Code != ErrResNoCmd || resp.Error.Message != "cmd not found : {none|such}" {
+		t.Fatalf("restart response %+v", resp)
+	}
+	resp = call(`{"v":1,"id":11,"method":"unknown"}`)
+	if resp.Error == nil || resp.Error.Code != ErrResUdfMethod {
+		t.Fatalf("unknown response %+v", resp)
+	}
+}
+
+func TestLegacyMethod(t *testing.T) {
+	cases := []struct {
+		typ    string
+		args   []string
+		method string
+		name   string
+		code   int
+	}{
+		{MsgSigCtl, []string{"reload"}, MethodReload, "", ErrResCodeNo},
+		{MsgSigCtl, []string{"exit"}, MethodShutdown, "", ErrResCodeNo},
+		{MsgSigCtl, []string{"act", "1", "test"}, MethodRestart, "test", ErrResCodeNo},
+		{MsgSigCtl, []string{"act", "x", "test"}, "", "", ErrResCtlSig},
+		{MsgSigCtl, []string{"test"}, "", "", ErrResWrgSig},
+		{MsgSigStat, []string{"cmd", "test", "output"}, MethodOutput, "test", ErrResCodeNo},
+		{MsgSigStat, []string{"cmd"}, "", "", ErrResMissCmd},
+		{MsgSigStat, []string{"server"}, MethodStatus, "", ErrResCodeNo},
+		{"foo", []string{"server"}, "", "", ErrResUdfCtl},
+	}
+	for _, c := range cases {
+		method, params, _, code := legacyMethod(c.typ, c.args)
+		if method != c.method || params.Name != c.name || code != c.code {
+			t.Errorf("%s %v : got %s %s %d", c.typ, c.args, method, params.Name, code)
+		}
+	}
+}
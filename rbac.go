@@ -0,0 +1,310 @@
+package taskeeper
+
+import (
+	"crypto/subtle"
+	"errors"
+	"os/user"
+	"path"
+	"strconv"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//角色可以配置的操作
+const (
+	ActionStat     = "stat"     //查询状态和输出
+	ActionStart    = "start"    //启动命令
+	ActionStop     = "stop"     //停止或暂停命令
+	ActionRestart  = "restart"  //重启命令
+	ActionExec     = "exec"     //单次执行命令
+	ActionReload   = "reload"   //重新加载配置
+	ActionShutdown = "shutdown" //keeper退出
+	ActionAll      = "*"        //所有操作
+)
+
+//方法对应的操作
+var methodActions = map[string]string{
+	MethodStatus:    ActionStat,
+	MethodCommands:  ActionStat,
+	MethodCommand:   ActionStat,
+	MethodOutput:    ActionStat,
+	MethodConfig:    ActionStat,
+	StatTail:        ActionStat,
+	MethodAudit:     ActionStat,
+	MethodSubscribe: ActionStat,
+	MethodMetrics:   ActionStat,
+	MethodStart:     ActionStart,
+	MethodStop:      ActionStop,
+	MethodPause:     ActionStop,
+	MethodRestart:   ActionRestart,
+	MethodExec:      ActionExec,
+	MethodReload:    ActionReload,
+	MethodShutdown:  ActionShutdown,
+}
+
+//rbacUsers 配置的用户 为空时不按角色校验
+var rbacUsers []*rbacUser
+
+//rbacRole 角色 允许对匹配的命令执行的操作
+type rbacRole struct {
+	actions  map[string]bool //允许的操作
+	commands []string        //命令名称的匹配规则 `*` 匹配所有命令
+	groups   map[string]bool //允许的命令分组
+}
+
+//没有目标时需要角色匹配所有命令的查询 返回的内容无法按命令过滤
+var unscopedStatMethods = map[string]bool{
+	MethodConfig:  true,
+	MethodMetrics: true,
+}
+
+//rbacUser 用户 通过token 客户端证书CN 或者unix socket客户端的uid识别
+type rbacUser struct {
+	name     string
+	tokenSum []byte
+	certCN   string
+	uid      int //unix socket客户端的uid 为-1时不按uid识别
+	roles    []*rbacRole
+}
+
+//按token 客户端证书CN 或者unix socket客户端的uid查找用户 token优先
+func findUser(token, cn string, cred *PeerCred) *rbacUser {
+	if token != "" {
+		sum := tokenSum(token)
+		for _, u := range rbacUsers {
+			if u.tokenSum != nil && subtle.ConstantTimeCompare(sum, u.tokenSum) == 1 {
+				return u
+			}
+		}
+	}
+	if cn != "" {
+		for _, u := range rbacUsers {
+			if u.certCN == cn {
+				return u
+			}
+		}
+	}
+	if cred != nil {
+		for _, u := range rbacUsers {
+			if u.uid >= 0 && u.uid == cred.UID {
+				return u
+			}
+		}
+	}
+	return nil
+}
+
+//用户是否可以对目标执行方法
+func (u *rbacUser) allowed(method, target string) bool {
+	action, ok := methodActions[method]
+	if !ok {
+		return false
+	}
+	for _, r := range u.roles {
+		if (r.actions[ActionAll] || r.actions[action]) && r.match(method, action, target) {
+			return true
+		}
+	}
+	return false
+}
+
+//用户是否可以查询命令 用于过滤列表和事件
+func (u *rbacUser) canStat(name, group string) bool {
+	for _, r := range u.roles {
+		if (r.actions[ActionAll] || r.actions[ActionStat]) && r.matchCmd(name, group) {
+			return true
+		}
+	}
+	return false
+}
+
+//用户是否可以查询所有命令
+func (u *rbacUser) canStatAll() bool {
+	for _, r := range u.roles {
+		if (r.actions[ActionAll] || r.actions[ActionStat]) && r.matchAll() {
+			return true
+		}
+	}
+	return false
+}
+
+//角色是否包含目标命令
+//没有目标时 可以过滤结果的查询需要角色包含命令 其他操作作用于所有命令 需要角色匹配所有命令
+func (r *rbacRole) match(method, action, target string) bool {
+	if target == "" {
+		if action == ActionStat && !unscopedStatMethods[method] {
+			return len(r.commands) > 0 || len(r.groups) > 0
+		}
+		return r.matchAll()
+	}
+	name, group := target, ""
+	if cmd, ok := findCmd(target); ok {
+		name, group = cmd.Name(), cmd.Group()
+	}
+	return r.matchCmd(name, group)
+}
+
+//角色是否匹配所有命令
+func (r *rbacRole) matchAll() bool {
+	for _, p := range r.commands {
+		if p == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+//角色是否包含命令名称或分组
+func (r *rbacRole) matchCmd(name, group string) bool {
+	if group != "" && r.groups[group] {
+		return true
+	}
+	for _, p := range r.commands {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//按用户的角色过滤查询结果 只保留可以查询的命令
+//用户为nil时不过滤
+func filterResult(u *rbacUser, method string, result interface{}) interface{} {
+	if u == nil || u.canStatAll() {
+		return result
+	}
+	//按名称或id判断命令是否可以查询
+	visible := func(target string) bool {
+		cmd, ok := findCmd(target)
+		return ok && u.canStat(cmd.Name(), cmd.Group())
+	}
+	switch res := result.(type) {
+	case []interface{}:
+		list := make([]interface{}, 0, len(res))
+		for _, v := range res {
+			if cs, ok := v.(CmdStatus); ok && u.canStat(cs.Name, cs.Group) {
+				list = append(list, v)
+			}
+		}
+		return list
+	case RunningStatus:
+		filter := func(ids []string) []string {
+			list := make([]string, 0, len(ids))
+			for _, id := range ids {
+				if visible(id) {
+					list = append(list, id)
+				}
+			}
+			return list
+		}
+		res.RunningTasks = filter(res.RunningTasks)
+		res.TermTasks = filter(res.TermTasks)
+		res.SecCronList = filter(res.SecCronList)
+		res.MinCronList = filter(res.MinCronList)
+		return res
+	case []AuditEntry:
+		//没有目标命令的记录只对可以查询所有命令的用户可见
+		list := []AuditEntry{}
+		for _, e := range res {
+			if e.Target != "" && visible(e.Target) {
+				list = append(list, e)
+			}
+		}
+		return list
+	}
+	return result
+}
+
+//读取角色和用户配置
+//roles: {name: {actions: [], commands: [], groups: []}}
+//users: {name: {token|token_file: "", cert_cn: "", unix_user: "", roles: []}}
+func loadRBACConfig(cnf *configurator.Config) error {
+	rbacUsers = nil
+	roles := make(map[string]*rbacRole)
+	roleList, _ := cnf.Get("roles").MapString()
+	for name, v := range roleList {
+		rc := configurator.BuildConfig(v)
+		r := &rbacRole{actions: make(map[string]bool), groups: make(map[string]bool)}
+		actions, _ := rc.Get("actions").ArrayString()
+		for _, a := range actions {
+			if !validAction(a) {
+				return errors.New("roles error : undefined action `" + a + "` in role " + name)
+			}
+			r.actions[a] = true
+		}
+		r.commands, _ = rc.Get("commands").ArrayString()
+		for _, p := range r.commands {
+			if _, err := path.Match(p, ""); err != nil {
+				return errors.New("roles error : bad command pattern `" + p + "` in role " + name)
+			}
+		}
+		groups, _ := rc.Get("groups").ArrayString()
+		for _, g := range groups {
+			r.groups[g] = true
+		}
+		roles[name] = r
+	}
+
+	userList, _ := cnf.Get("users").MapString()
+	users := make([]*rbacUser, 0, len(userList))
+	for name, v := range userList {
+		uc := configurator.BuildConfig(v)
+		u := &rbacUser{name: name, uid: -1}
+		token, err := readToken(uc, "token")
+		if err != nil {
+			return errors.New("users error : " + name + " " + err.Error())
+		}
+		if token != "" {
+			u.tokenSum = tokenSum(token)
+		}
+		u.certCN, _ = uc.Get("cert_cn").String()
+		if !uc.Get("unix_user").IsNil() {
+			unixUser, _ := uc.Get("unix_user").String()
+			if uid, err := uc.Get("unix_user").Int(); err == nil {
+				unixUser = strconv.Itoa(uid)
+			}
+			if u.uid, err = lookupUID(unixUser); err != nil {
+				return errors.New("users error : " + name + " unix_user " + err.Error())
+			}
+		}
+		if u.tokenSum == nil && u.certCN == "" && u.uid < 0 {
+			return errors.New("users error : " + name + " need token, cert_cn or unix_user")
+		}
+		roleNames, _ := uc.Get("roles").ArrayString()
+		for _, rn := range roleNames {
+			r, ok := roles[rn]
+			if !ok {
+				return errors.New("users error : undefined role `" + rn + "` for " + name)
+			}
+			u.roles = append(u.roles, r)
+		}
+		users = append(users, u)
+	}
+	rbacUsers = users
+	return nil
+}
+
+//是否是可以配置的操作
+func validAction(a string) bool {
+	if a == ActionAll {
+		return true
+	}
+	for _, v := range methodActions {
+		if v == a {
+			return true
+		}
+	}
+	return false
+}
+
+//unix用户名或uid对应的uid
+func lookupUID(name string) (int, error) {
+	if uid, err := strconv.Atoi(name); err == nil && uid >= 0 {
+		return uid, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
@@ -0,0 +1,128 @@
+package taskeeper
+
+import (
+	"testing"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+func TestRBAC(t *testing.T) {
+	oldCmds, oldNameMap, oldUsers := cmds, cmdNameMap, rbacUsers
+	defer func() {
+		cmds, cmdNameMap, rbacUsers = oldCmds, oldNameMap, oldUsers
+	}()
+	web := NewCommand("/bin/true", nil, "").SetName("web-api").SetGroup("web")
+	db := NewCommand("/bin/true", nil, "").SetName("db-backup").SetGroup("db")
+	web.SetID("webid")
+	db.SetID("dbid")
+	cmds = map[string]*Command{web.ID(): web, db.ID(): db}
+	cmdNameMap = map[string]string{web.Name(): web.ID(), db.Name(): db.ID()}
+
+	cnf := configurator.BuildConfig(map[string]interface{}{
+		"roles": map[interface{}]interface{}{
+			"web-ops": map[interface{}]interface{}{
+				"actions":  []interface{}{"stat", "start", "stop", "restart"},
+				"commands": []interface{}{"web-*"},
+			},
+			"db-ops": map[interface{}]interface{}{
+				"actions": []interface{}{"*"},
+				"groups":  []interface{}{"db"},
+			},
+			"admin": map[interface{}]interface{}{
+				"actions":  []interface{}{"*"},
+				"commands": []interface{}{"*"},
+			},
+		},
+		"users": map[interface{}]interface{}{
+			"alice":  map[interface{}]interface{}{"token": "alice-token", "roles": []interface{}{"web-ops"}},
+			"bob":    map[interface{}]interface{}{"cert_cn": "bob", "roles": []interface{}{"db-ops"}},
+			"root":   map[interface{}]interface{}{"token": "root-token", "roles": []interface{}{"admin"}},
+			"deploy": map[interface{}]interface{}{"unix_user": 12345, "roles": []interface{}{"web-ops"}},
+		},
+	})
+	if err := loadRBACConfig(cnf); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tcp := &peer{addr: "127.0.0.1:1234"}
+	bob := &peer{addr: "127.0.0.1:1235", identity: "bob"}
+	deploy := &peer{addr: "unix:test.sock", trusted: true, cred: &PeerCred{UID: 12345}}
+	stranger := &peer{addr: "unix:test.sock", trusted: true, cred: &PeerCred{UID: 54321}}
+	cases := []struct {
+		p      *peer
+		token  string
+		method string
+		target string
+		user   string
+		code   int
+	}{
+		{tcp, "alice-token", MethodRestart, "web-api", "alice", ErrResCodeNo},
+		{tcp, "alice-token", MethodPause, "web", "alice", ErrResCodeNo},
+		{tcp, "alice-token", MethodRestart, "db-backup", "alice", ErrResDenied},
+		{tcp, "alice-token", MethodExec, "web-api", "alice", ErrResDenied},
+		{tcp, "alice-token", MethodReload, "", "alice", ErrResDenied},
+		{tcp, "alice-token", MethodStatus, "", "alice", ErrResCodeNo},
+		{bob, "", MethodExec, "db-backup", "bob", ErrResCodeNo},
+		{bob, "", MethodStop, "web-api", "bob", ErrResDenied},
+		{bob, "", MethodStart, "", "bob", ErrResDenied},
+		{tcp, "root-token", MethodShutdown, "", "root", ErrResCodeNo},
+		{tcp, "wrong", MethodStatus, "", "", ErrResAuth},
+		{tcp, "alice-token", MethodCommands, "", "alice", ErrResCodeNo},
+		{tcp, "alice-token", MethodConfig, "", "alice", ErrResDenied},
+		{tcp, "alice-token", MethodMetrics, "", "alice", ErrResDenied},
+		{tcp, "root-token", MethodConfig, "", "root", ErrResCodeNo},
+		{deploy, "", MethodRestart, "web-api", "deploy", ErrResCodeNo},
+		{deploy, "", MethodRestart, "db-backup", "deploy", ErrResDenied},
+		{stranger, "", MethodStatus, "", "", ErrResAuth},
+		{stranger, "root-token", MethodShutdown, "", "root", ErrResCodeNo},
+	}
+	for _, c := range cases {
+		user, _, code := c.p.authorize(c.token, c.method, c.target)
+		if user != c.user || code != c.code {
+			t.Errorf("%s %s %s : got %s %d, want %s %d", c.token, c.method, c.target, user, code, c.user, c.code)
+		}
+	}
+
+	//列表和事件只包含用户可以查询的命令
+	alice := findUser("alice-token", "", nil)
+	list := filterResult(alice, MethodCommands, []interface{}{
+		CmdStatus{ID: web.ID(), Name: web.Name(), Group: web.Group()},
+		CmdStatus{ID: db.ID(), Name: db.Name(), Group: db.Group()},
+	}).([]interface{})
+	if len(list) != 1 || list[0].(CmdStatus).Name != web.Name() {
+		t.Errorf("filtered commands %v", list)
+	}
+	status := filterResult(alice, MethodStatus, RunningStatus{RunningTasks: []string{web.ID(), db.ID()}}).(RunningStatus)
+	if len(status.RunningTasks) != 1 || status.RunningTasks[0] != web.ID() {
+		t.Errorf("filtered running tasks %v", status.RunningTasks)
+	}
+	entries := []AuditEntry{{Target: "web-api"}, {Target: "db-backup"}, {Method: MethodReload}}
+	audits := filterResult(alice, MethodAudit, entries).([]AuditEntry)
+	if len(audits) != 1 || audits[0].Target != "web-api" {
+		t.Errorf("filtered audit %v", audits)
+	}
+	if root := findUser("root-token", "", nil); len(filterResult(root, MethodAudit, entries).([]AuditEntry)) != len(entries) {
+		t.Error("audit filtered for admin")
+	}
+	sub := &subscriber{user: alice}
+	if !sub.match(&Event{ID: web.ID(), Name: web.Name()}) || sub.match(&Event{ID: db.ID(), Name: db.Name(), Group: db.Group()}) {
+		t.Error("subscriber received events of other commands")
+	}
+
+	//没有配置用户时 unix socket客户端由文件权限控制
+	rbacUsers = nil
+	if _, _, code := stranger.authorize("", MethodShutdown, ""); code != ErrResCodeNo {
+		t.Errorf("unix peer without users : got %d", code)
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"roles": map[interface{}]interface{}{"r": map[interface{}]interface{}{"actions": []interface{}{"fly"}}}},
+		{"users": map[interface{}]interface{}{"u": map[interface{}]interface{}{"token": "x", "roles": []interface{}{"none"}}}},
+		{"users": map[interface{}]interface{}{"u": map[interface{}]interface{}{"roles": []interface{}{}}}},
+		{"users": map[interface{}]interface{}{"u": map[interface{}]interface{}{"unix_user": "no-such-user-x", "roles": []interface{}{}}}},
+	} {
+		if err := loadRBACConfig(configurator.BuildConfig(bad)); err == nil {
+			t.Errorf("config %v should fail", bad)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package taskeeper
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//备份文件名中的时间格式
+const rotateTimeFormat = "20060102-150405"
+
+//RotateConfig 日志切割配置
+type RotateConfig struct {
+	MaxSize    int64         //单个文件的最大字节数 超过后切割
+	MaxBackups int           //最多保留的备份文件数 0为不限制
+	MaxAge     time.Duration //备份文件最长保留时间 0为不限制
+	Compress   bool          //是否使用gzip压缩备份文件
+	Interval   time.Duration //按时间切割的间隔 0为不按时间切割
+}
+
+//是否需要切割
+func (rc RotateConfig) enabled() bool {
+	return rc.MaxSize > 0 || rc.Interval > 0
+}
+
+//RotateWriter 按大小和时间切割的日志文件
+//所有写入都经过keeper 可以在收到SIGHUP时重新打开文件
+type RotateWriter struct {
+	path     string
+	conf     RotateConfig
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	openTime time.Time
+	pruned   bool //已从配置中移除 之后的写入不保持文件打开
+}
+
+var (
+	//rotateWriters 所有正在使用的切割文件 按路径复用
+	rotateWriters = make(map[string]*RotateWriter)
+	//rotateLock 切割文件map的锁
+	rotateLock sync.Mutex
+	//rotateCleanLock 备份清理的锁 后台清理依次执行 避免压缩和删除交错
+	rotateCleanLock sync.Mutex
+)
+
+//获取一个路径对应的切割文件 同一路径只会创建一次
+func getRotateWriter(path string, conf RotateConfig) *RotateWriter {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	if w, ok := rotateWriters[path]; ok {
+		w.lock.Lock()
+		w.conf = conf
+		w.lock.Unlock()
+		return w
+	}
+	w := &RotateWriter{path: path, conf: conf}
+	rotateWriters[path] = w
+	return w
+}
+
+//关闭并移除不再使用的切割文件 用于重载配置后
+func pruneRotateWriters(paths map[string]bool) {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	for path, w := range rotateWriters {
+		if paths[path] {
+			continue
+		}
+		w.lock.Lock()
+		w.pruned = true
+		if err := w.close(); err != nil {
+			log.Println("rotate close " + path + " error : " + err.Error())
+		}
+		w.lock.Unlock()
+		delete(rotateWriters, path)
+	}
+}
+
+//重新打开所有切割文件 用于外部工具移动文件后
+func reopenRotateWriters() {
+	rotateLock.Lock()
+	defer rotateLock.Unlock()
+	for path, w := range rotateWriters {
+		if err := w.Reopen(); err != nil {
+			log.Println("rotate reopen " + path + " error : " + err.Error())
+		}
+	}
+}
+
+//Write 写入内容 超过大小或时间间隔时先切割
+func (w *RotateWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+	if w.needRotate(int64(len(p))) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if w.pruned {
+		//旧进程结束前的剩余输出 写完即关闭
+		w.close()
+	}
+	return n, err
+}
+
+//Reopen 关闭并重新打开文件
+func (w *RotateWriter) Reopen() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.close()
+	return w.open()
+}
+
+//Close 关闭文件 再次写入时会重新打开
+func (w *RotateWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.close()
+}
+
+//Path 获取文件路径
+func (w *RotateWriter) Path() string {
+	return w.path
+}
+
+//打开文件并记录当前大小
+func (w *RotateWriter) open() error {
+	if w.path == "" {
+		return errors.New("rotate file path empty")
+	}
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	w.openTime = time.Now()
+	return nil
+}
+
+//关闭文件
+func (w *RotateWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+//判断本次写入前是否需要切割
+func (w *RotateWriter) needRotate(n int64) bool {
+	if w.conf.MaxSize > 0 && w.size > 0 && w.size+n > w.conf.MaxSize {
+		return true
+	}
+	if w.conf.Interval > 0 && time.Since(w.openTime) >= w.conf.Interval {
+		return true
+	}
+	return false
+}
+
+//将当前文件重命名为备份 打开新文件 并在后台清理备份
+func (w *RotateWriter) rotate() error {
+	w.close()
+	backup := w.path + "." + time.Now().Format(rotateTimeFormat)
+	for i := 1; fileExists(backup) || fileExists(backup+".gz"); i++ {
+		backup = w.path + "." + time.Now().Format(rotateTimeFormat) + "." + strconv.Itoa(i)
+	}
+	if err := os.Rename(w.path, backup); err != nil && !os.IsNotExist(err) {
+		log.Println("rotate rename " + w.path + " error : " + err.Error())
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	go cleanRotateBackups(w.path, backup, w.conf)
+	return nil
+}
+
+//压缩新的备份文件 并删除超过数量和时间的备份
+func cleanRotateBackups(path, backup string, conf RotateConfig) {
+	rotateCleanLock.Lock()
+	defer rotateCleanLock.Unlock()
+	if conf.Compress && fileExists(backup) {
+		if err := gzipFile(backup); err != nil {
+			log.Println("rotate compress " + backup + " error : " + err.Error())
+		}
+	}
+	if conf.MaxBackups <= 0 && conf.MaxAge <= 0 {
+		return
+	}
+	//按目录遍历 避免路径中的通配符影响匹配
+	infos, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return
+	}
+	type backupFile struct {
+		name string
+		time time.Time
+		seq  int
+	}
+	var backups []backupFile
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		if t, seq, ok := parseRotateBackup(filepath.Base(path), info.Name()); ok {
+			backups = append(backups, backupFile{filepath.Join(filepath.Dir(path), info.Name()), t, seq})
+		}
+	}
+	//新的备份在前 按文件名中的时间和序号排序 不受压缩时间影响
+	sort.Slice(backups, func(i, j int) bool {
+		if !backups[i].time.Equal(backups[j].time) {
+			return backups[i].time.After(backups[j].time)
+		}
+		return backups[i].seq > backups[j].seq
+	})
+	for i, b := range backups {
+		expired := conf.MaxAge > 0 && time.Since(b.time) > conf.MaxAge
+		if (conf.MaxBackups > 0 && i >= conf.MaxBackups) || expired {
+			if err := os.Remove(b.name); err != nil {
+				log.Println("rotate remove " + b.name + " error : " + err.Error())
+			}
+		}
+	}
+}
+
+//解析切割产生的备份文件名 返回切割时间和序号
+//备份名为 路径.时间[.序号][.gz] 其他同前缀的文件不处理
+func parseRotateBackup(path, name string) (time.Time, int, bool) {
+	var t time.Time
+	if !strings.HasPrefix(name, path+".") {
+		return t, 0, false
+	}
+	suffix := strings.TrimSuffix(strings.TrimPrefix(name, path+"."), ".gz")
+	if len(suffix) < len(rotateTimeFormat) {
+		return t, 0, false
+	}
+	t, err := time.ParseInLocation(rotateTimeFormat, suffix[:len(rotateTimeFormat)], time.Local)
+	if err != nil {
+		return t, 0, false
+	}
+	suffix = suffix[len(rotateTimeFormat):]
+	if suffix == "" {
+		return t, 0, true
+	}
+	if !strings.HasPrefix(suffix, ".") {
+		return t, 0, false
+	}
+	seq, err := strconv.Atoi(suffix[1:])
+	if err != nil || seq <= 0 || strconv.Itoa(seq) != suffix[1:] {
+		return t, 0, false
+	}
+	return t, seq, true
+}
+
+//将文件压缩为 .gz 并删除原文件
+func gzipFile(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name+".gz.tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz.tmp")
+		return err
+	}
+	if err = os.Rename(name+".gz.tmp", name+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+//读取日志切割配置
+//log_max_size log_max_backups log_max_age log_compress log_rotate_interval
+func buildRotateConfig(cnf *configurator.Config) (RotateConfig, error) {
+	var rc RotateConfig
+	var err error
+	rc.MaxSize, err = getSize(cnf.Get("log_max_size"))
+	if err != nil {
+		return rc, errors.New("log_max_size error : " + err.Error())
+	}
+	if !cnf.Get("log_max_backups").IsNil() {
+		rc.MaxBackups, err = cnf.Get("log_max_backups").Int()
+		if err != nil || rc.MaxBackups < 0 {
+			return rc, errors.New("log_max_backups error : need a positive integer")
+		}
+	}
+	rc.MaxAge, err = getDuration(cnf.Get("log_max_age"))
+	if err != nil {
+		return rc, errors.New("log_max_age error : " + err.Error())
+	}
+	rc.Interval, err = getDuration(cnf.Get("log_rotate_interval"))
+	if err != nil {
+		return rc, errors.New("log_rotate_interval error : " + err.Error())
+	}
+	rc.Compress = getBool(cnf.Get("log_compress"))
+	return rc, nil
+}
@@ -0,0 +1,91 @@
+package taskeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotateWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskeeper-rotate")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "cmd.log")
+	//同前缀但不是备份的文件不能被清理
+	other := name + ".err"
+	if err := ioutil.WriteFile(other, []byte("err"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	w := getRotateWriter(name, RotateConfig{MaxSize: 10, MaxBackups: 2, Compress: true})
+	defer pruneRotateWriters(nil)
+	for i := 0; i < 4; i++ {
+		if _, err := w.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	w.Close()
+
+	//等待后台压缩和清理完成
+	var backups []string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		backups = rotateBackups(name)
+		done := len(backups) == 2
+		for _, b := range backups {
+			done = done && strings.HasSuffix(b, ".gz")
+		}
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backups not cleaned : %v", backups)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Log("backups :", backups)
+	if !fileExists(other) {
+		t.Fatal("unrelated file removed : " + other)
+	}
+	data, _ := ioutil.ReadFile(name)
+	if string(data) != "0123456789" {
+		t.Fatalf("current file content %q", data)
+	}
+}
+
+func TestParseRotateBackup(t *testing.T) {
+	cases := map[string]bool{
+		"app.log.20200102-030405":        true,
+		"app.log.20200102-030405.gz":     true,
+		"app.log.20200102-030405.3":      true,
+		"app.log.20200102-030405.3.gz":   true,
+		"app.log.20200102-030405.gz.tmp": false,
+		"app.log.20200102-030405.03":     false,
+		"app.log.20200102-030405x":       false,
+		"app.log.err":                    false,
+		"app.log.1":                      false,
+		"app.logs.20200102-030405":       false,
+	}
+	for name, want := range cases {
+		if _, _, ok := parseRotateBackup("app.log", name); ok != want {
+			t.Fatalf("parse %s got %v", name, ok)
+		}
+	}
+}
+
+//列出目录中的备份文件 包括压缩中的临时文件
+func rotateBackups(name string) []string {
+	matches, _ := filepath.Glob(name + ".*")
+	var backups []string
+	for _, m := range matches {
+		if !strings.HasSuffix(m, ".err") {
+			backups = append(backups, m)
+		}
+	}
+	return backups
+}
@@ -3,7 +3,9 @@ package taskeeper
 import (
 	"errors"
 	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	cron "github.com/kasiss-liu/gocrontab"
@@ -27,11 +29,23 @@ type State struct {
 	IsRun       bool                //是否已经开始运行
 }
 
+const (
+	//没有配置starting_deadline时 最多补偿的时间窗口
+	maxCatchUpWindow = 24 * time.Hour
+	//catch_up为all时 最多补偿的执行次数 超出时只补偿最近的执行
+	maxCatchUpRuns = 100
+	//命令中断时日志中附带的最近输出的最大字节数
+	brokenOutputTail = 2048
+)
+
 //运行时的必要参数
 var (
 	RunState    *State //状态机实例
 	breakGap    int64  //异常中断容忍间隔
 	brokenTimes = 5    //异常终端容忍次数
+
+	runStop     chan struct{}  //Run退出时关闭 通知后台协程结束
+	runRoutines sync.WaitGroup //Run退出前需要等待结束的后台协程
 )
 
 func init() {
@@ -43,11 +57,15 @@ func init() {
 //子程序 启动、监控并等待操作信号
 func Run() {
 
-	//进程结束时 删除主进程和子进程的pid文件
+	//进程结束时 停止后台协程 删除主进程和子进程的pid文件
+	runStop = make(chan struct{})
 	defer func() {
+		close(runStop)
+		runRoutines.Wait()
 		delPidFile()
 		delPidDescFile()
 		delChildPidsFile()
+		removeCgroups()
 	}()
 
 	err := savePid()
@@ -55,6 +73,9 @@ func Run() {
 		log.Println("run process prepare failed !")
 		return
 	}
+	//读取上次运行保存的状态 恢复命令的暂停标记
+	loadKeeperState()
+	restorePaused()
 
 	//初始化状态机实力参数
 	initTask()
@@ -66,6 +87,10 @@ func Run() {
 	}
 	//启动监控服务数据同步器
 	syncStateToCopy()
+	//定时写入持久化状态
+	syncKeeperState()
+	//启动进程资源的采样
+	startProcSampler()
 	//按照配置启动命令
 	for {
 		sig := <-signalChan
@@ -76,20 +101,28 @@ func Run() {
 			if err == nil {
 				log.Println("run prepare reload process ...")
 				exitTask()
+				//旧进程结束后 关闭已从配置中移除的输出文件
+				pruneRotateWriters(rotatePaths())
 				initTask()
 				startTask()
-				log.Println("run process reloaded !")
+				e := newEvent(LevelInfo, EventReload, nil, "run process reloaded !")
+				logEvent(e)
+				fireHooks(HookReload, nil, e, "")
 			}
 		//接收到启动信号后 直接按照配置变量数据启动进程
 		case sigStart:
-			startTask()
+			//暂停之后重新启动
+			resumed := StartTime > 0
+			if startTask() == nil && resumed {
+				logEvent(newEvent(LevelInfo, EventResume, nil, "keeper resumed!"))
+			}
 		//接收到退出信号后 按次序杀死管理的进程 退出主程序
 		case sigPause:
 			log.Println("keeper pausing!")
 			log.Println("run starting exit process ...")
 			exitTask()
 			log.Println("run all process exit !")
-			log.Println("keeper paused!")
+			logEvent(newEvent(LevelInfo, EventPause, nil, "keeper paused!"))
 		case sigExit:
 			log.Println("run starting exit process ...")
 			exitTask()
@@ -113,19 +146,38 @@ func runDeamonRoutine(id string, c *Command) {
 		log.Println("cmd:" + id + " is running")
 		return
 	}
+	RunState.Numlock.Lock()
 	RunState.BrokenTries[id] = 0
-	for {
+	RunState.Numlock.Unlock()
+	//上次退出是否由资源上限检查停止
+	watchdog := false
+	for started := false; ; started = true {
 		//启动命令
 		c.Start()
 		//如果pid==0 则进程启动失败 该进程将不再重试
 		if c.Pid() == 0 {
 			RunState.Numlock.Lock()
 			RunState.BrokenNum++
-			RunState.Numlock.Unlock()
 			RunState.BrokenList[id] = c
-			log.Println("cmd:" + id + " start failed no try")
+			RunState.Numlock.Unlock()
+			metricBroken(c)
+			e := newEvent(LevelError, EventBroken, c, "cmd:"+id+" start failed no try")
+			logEvent(e)
+			fireHooks(HookBroken, c, e, "")
 			break
 		}
+		metricStarted(c, started && !watchdog)
+		var e *Event
+		if watchdog {
+			metricWatchdogRestart(c)
+			e = newEvent(LevelWarn, EventRestart, c, "cmd:"+id+" restarted by watchdog pid:"+strconv.Itoa(c.Pid()))
+		} else if started {
+			e = newEvent(LevelWarn, EventRestart, c, "cmd:"+id+" restarted pid:"+strconv.Itoa(c.Pid()))
+		} else {
+			e = newEvent(LevelInfo, EventStart, c, "cmd:"+id+" started pid:"+strconv.Itoa(c.Pid()))
+		}
+		logEvent(e)
+		fireHooks(HookStart, c, e, "")
 		//进程运行数+1
 		RunState.Numlock.Lock()
 		RunState.RunningNum++
@@ -135,40 +187,69 @@ func runDeamonRoutine(id string, c *Command) {
 
 		//等待程序运行结束
 		if c.Pid() > 0 {
-			_, err := c.Wait()
+			pid := c.Pid()
+			state, err := c.Wait()
 			//如果程序异常导致运行结束 打印异常退出原因
 			if err != nil {
 				log.Println("run routine except exit cmd:" + id + " errmsg:" + err.Error())
 			}
+			exitCode := -1
+			if state != nil {
+				exitCode = state.ExitCode()
+			}
+			c.ResetPid()
+			metricExited(c, exitCode)
+			setLastExit(c.Name(), pid, exitCode)
+			e := newEvent(LevelInfo, EventExit, c, "cmd:"+id+" exited code:"+strconv.Itoa(exitCode)).withPid(pid).withExitCode(exitCode)
+			logEvent(e)
+			fireHooks(HookExit, c, e, "")
 		}
+		watchdog = c.takeWatchdogStop()
 		//验证是否是管理程序主动退出协程
+		RunState.Numlock.Lock()
 		if _, ok := RunState.RunningList[id]; !ok {
+			RunState.Numlock.Unlock()
 			//log.Println("manager exit id:" + id)
 			break
 		}
 		//从运行中状态机中移除本命令
-		RunState.Numlock.Lock()
 		RunState.RunningNum--
 		delete(RunState.RunningList, id)
 		RunState.Numlock.Unlock()
 
+		//资源超限被停止的进程直接重启 不计入中断次数
+		if watchdog {
+			continue
+		}
+		addCrash(c.Name())
+
 		//记录结束时间点
 		brkTime := time.Now()
+		RunState.Numlock.Lock()
 		//验证本命令是否曾经运行结束
 		if ts, ok := RunState.BrokenPoints[id]; ok {
 			//验证上次结束的时间与本次时间 间隔是否大于设定的间隔(s)
 			if brkTime.Unix()-ts <= breakGap {
 				//如果小于 则本命令的重试次数+1
 				RunState.BrokenTries[id]++
-				if RunState.BrokenTries[id] >= brokenTimes {
+				tries := RunState.BrokenTries[id]
+				if tries >= brokenTimes {
 					//如果重试次数超限 则该进程存在异常 应该退出
-					RunState.Numlock.Lock()
 					RunState.BrokenNum++
 					RunState.BrokenList[id] = c
 					RunState.Numlock.Unlock()
+					metricBroken(c)
+					msg := "run cmd:" + id + " BROKEN after " + strconv.Itoa(tries) + " retries"
+					if c.outputRing != nil {
+						msg += ", last output :\n" + string(c.outputRing.Tail(brokenOutputTail))
+					}
+					e := newEvent(LevelError, EventBroken, c, msg)
+					logEvent(e)
+					fireHooks(HookBroken, c, e, "")
 
 					break
 				}
+				RunState.Numlock.Unlock()
 				continue
 			}
 		}
@@ -177,12 +258,16 @@ func runDeamonRoutine(id string, c *Command) {
 		//并更新时间点
 		RunState.BrokenTries[id] = 1
 		RunState.BrokenPoints[id] = brkTime.Unix()
+		RunState.Numlock.Unlock()
 	}
 }
 
 //执行退出时，停止所有管理的进程
 func exitTask() {
-	for id, cmd := range RunState.RunningList {
+	RunState.Numlock.Lock()
+	running := copyCmdMap(RunState.RunningList)
+	RunState.Numlock.Unlock()
+	for id, cmd := range running {
 		exitSingleTask(id, cmd)
 	}
 	RunState.IsRun = false
@@ -197,12 +282,12 @@ func exitSingleTask(id string, cmd *Command) {
 	if cmd.Pid() > 0 {
 		err := cmd.Kill()
 		if err != nil {
-			log.Println("run kill " + id + "error : " + err.Error())
+			logEvent(newEvent(LevelError, EventExit, cmd, "run kill "+id+" error : "+err.Error()))
 		} else {
-			log.Println("run kill cmd : " + id)
+			logEvent(newEvent(LevelInfo, EventExit, cmd, "run kill cmd : "+id))
 		}
 	} else {
-		log.Println("run kill cmd : " + id + "error: process not running")
+		logEvent(newEvent(LevelWarn, EventExit, cmd, "run kill cmd : "+id+" error: process not running"))
 	}
 }
 
@@ -213,12 +298,16 @@ func reloadTask() error {
 		log.Println("run reload read config error : " + err.Error())
 		return err
 	}
+	//新的命令保留通过控制命令设置的暂停
+	restorePaused()
 	return nil
 }
 
 //初始化任务状态机
+//在原状态机上重置 命令协程持有的状态机指针不变
 func initTask() {
-	RunState = &State{}
+	RunState.Numlock.Lock()
+	defer RunState.Numlock.Unlock()
 	//启动命令时 初始化状态数据
 	RunState.TasksNum = 0
 	RunState.RunningNum = 0
@@ -228,6 +317,8 @@ func initTask() {
 	RunState.BrokenTries = make(map[string]int)
 	RunState.BrokenPoints = make(map[string]int64)
 
+	RunState.CronState = false
+	RunState.IsRun = false
 	RunState.MinCronList = make(map[string]*Command)
 	RunState.SecCronList = make(map[string]*Command)
 }
@@ -244,9 +335,12 @@ func startTask() error {
 	RunState.IsRun = true
 
 	//启动服务
-	for id, cmd := range cmds {
+	all, _ := currentCmds()
+	for id, cmd := range all {
 		if !cmd.IsCron() {
+			RunState.Numlock.Lock()
 			RunState.TasksNum++
+			RunState.Numlock.Unlock()
 			if !cmd.IsPause() {
 				go runDeamonRoutine(id, cmd)
 				log.Println("run started cmd : " + id)
@@ -257,26 +351,34 @@ func startTask() error {
 		}
 		if cmd.IsCron() {
 			checkCronExpress(cmd)
+			if !cmd.IsPause() {
+				catchUpCron(cmd)
+			}
 			if !RunState.CronState {
+				runRoutines.Add(2)
 				go runSecondCronRoutine()
 				go runMinuteCronRoutine()
+				RunState.Numlock.Lock()
 				RunState.CronState = true
+				RunState.Numlock.Unlock()
 			}
 		}
 	}
-	//如果首次启动 记录启动时间
+	//如果首次启动 记录启动时间 控制请求会同时读取
 	if StartTime <= 0 {
-		StartTime = time.Now().Unix()
+		atomic.StoreInt64(&StartTime, time.Now().Unix())
 	} else {
 		//记录每次重载的时间
-		ReloadTime = append(ReloadTime, time.Now().Unix())
+		metricReload()
+		addReloadTime(time.Now().Unix())
 	}
 	return nil
 }
 
 //单独重启一个执行命令
 func restartTask(cid string) {
-	for id, cmd := range cmds {
+	all, _ := currentCmds()
+	for id, cmd := range all {
 		if id == cid {
 			//启动命令
 			if !cmd.IsCron() {
@@ -285,51 +387,69 @@ func restartTask(cid string) {
 				//开启新进程
 				if !cmd.IsPause() {
 					go runDeamonRoutine(id, cmd)
-					log.Println("run started cmd : " + id)
+					logEvent(newEvent(LevelInfo, EventRestart, cmd, "run restarted cmd : "+id))
 					return
 				}
-				log.Println("run restart error: Cmd is Paused -- " + id)
+				logEvent(newEvent(LevelWarn, EventRestart, cmd, "run restart error: Cmd is Paused -- "+id))
 				return
 			}
-			log.Println("run restart error: Cmd in Cron Type cannot be run -- " + id)
+			logEvent(newEvent(LevelWarn, EventRestart, cmd, "run restart error: Cmd in Cron Type cannot be run -- "+id))
 			return
 		}
 	}
-	log.Println("run restart error : No cmd found -- " + cid)
+	logEvent(newEvent(LevelWarn, EventLog, nil, "run restart error : No cmd found -- "+cid))
 	return
 }
 
 //启动秒级cron运行任务
 func runSecondCronRoutine() {
+	defer runRoutines.Done()
 	for {
-		for _, cmd := range RunState.SecCronList {
+		RunState.Numlock.Lock()
+		list := copyCmdMap(RunState.SecCronList)
+		RunState.Numlock.Unlock()
+		for _, cmd := range list {
 			if cron.ValidExpressNow(cmd.cronExpress) {
 				if !cmd.IsPause() {
-					log.Println("cron sec " + cmd.ID())
+					logEvent(newEvent(LevelDebug, EventCronFire, cmd, "cron sec "+cmd.ID()))
+					setCronFire(cmd.Name(), time.Now().Unix())
 					go doCronRoutine(cmd)
 				} else {
-					log.Println("cron sec " + cmd.ID() + "is paused")
+					logEvent(newEvent(LevelDebug, EventLog, cmd, "cron sec "+cmd.ID()+" is paused"))
 				}
 			}
 		}
-		time.Sleep(1 * time.Second)
+		select {
+		case <-runStop:
+			return
+		case <-time.After(1 * time.Second):
+		}
 	}
 }
 
 //启动分钟级cron运行任务
 func runMinuteCronRoutine() {
+	defer runRoutines.Done()
 	for {
-		for _, cmd := range RunState.MinCronList {
+		RunState.Numlock.Lock()
+		list := copyCmdMap(RunState.MinCronList)
+		RunState.Numlock.Unlock()
+		for _, cmd := range list {
 			if cron.ValidExpressNow(cmd.cronExpress) {
 				if !cmd.IsPause() {
-					log.Println("cron min " + cmd.ID())
+					logEvent(newEvent(LevelDebug, EventCronFire, cmd, "cron min "+cmd.ID()))
+					setCronFire(cmd.Name(), time.Now().Unix())
 					go doCronRoutine(cmd)
 				} else {
-					log.Println("cron min " + cmd.ID() + "is paused")
+					logEvent(newEvent(LevelDebug, EventLog, cmd, "cron min "+cmd.ID()+" is paused"))
 				}
 			}
 		}
-		time.Sleep(60 * time.Second)
+		select {
+		case <-runStop:
+			return
+		case <-time.After(60 * time.Second):
+		}
 	}
 }
 
@@ -344,6 +464,8 @@ func checkCronExpress(cmd *Command) {
 		log.Println(`cron express error: ` + err.Error())
 		return
 	}
+	RunState.Numlock.Lock()
+	defer RunState.Numlock.Unlock()
 	if c.IsSec() {
 		RunState.SecCronList[cmd.id] = cmd
 	} else {
@@ -352,23 +474,154 @@ func checkCronExpress(cmd *Command) {
 	RunState.TasksNum++
 }
 
+//补偿cron命令在keeper停止或暂停期间错过的执行
+func catchUpCron(cmd *Command) {
+	now := time.Now()
+	last, ok := getCronFire(cmd.Name())
+	if !ok {
+		//没有触发记录时 以当前时间作为起点
+		setCronFire(cmd.Name(), now.Unix())
+		return
+	}
+	if cmd.CatchUp() == CatchUpNone {
+		return
+	}
+	missed := missedCronTimes(cmd, time.Unix(last, 0), now)
+	if len(missed) == 0 {
+		return
+	}
+	log.Println("cron catch up cmd id: " + cmd.ID() + " missed " + strconv.Itoa(len(missed)) + " runs, policy " + cmd.CatchUp())
+	if cmd.CatchUp() == CatchUpLatest {
+		missed = missed[len(missed)-1:]
+	} else if len(missed) > maxCatchUpRuns {
+		log.Println("cron catch up cmd id: " + cmd.ID() + " skipped " + strconv.Itoa(len(missed)-maxCatchUpRuns) + " runs, at most " + strconv.Itoa(maxCatchUpRuns))
+		missed = missed[len(missed)-maxCatchUpRuns:]
+	}
+	setCronFire(cmd.Name(), missed[len(missed)-1].Unix())
+	//依次执行 上一次结束后再执行下一次
+	go func() {
+		for _, t := range missed {
+			log.Println("cron catch up cmd id: " + cmd.ID() + " schedule " + formatDate(t.Unix()))
+			doCronRoutine(cmd)
+		}
+	}()
+}
+
+//计算上次触发之后到现在 所有符合cron表达式的时间点
+//只计算starting_deadline窗口内的时间 当前这一刻交给cron协程处理
+func missedCronTimes(cmd *Command, last, now time.Time) []time.Time {
+	c, err := cron.NewCronWithExpress(cmd.cronExpress)
+	if err != nil {
+		log.Println(`cron express error: ` + err.Error())
+		return nil
+	}
+	step := time.Minute
+	if c.IsSec() {
+		step = time.Second
+	}
+	window := cmd.startingDeadline
+	if window <= 0 {
+		window = maxCatchUpWindow
+	}
+	from := last.Truncate(step).Add(step)
+	if earliest := now.Add(-window); from.Before(earliest) {
+		from = earliest.Truncate(step)
+		if from.Before(earliest) {
+			from = from.Add(step)
+		}
+	}
+	end := now.Truncate(step)
+
+	var times []time.Time
+	for t := from; t.Before(end); t = t.Add(step) {
+		if cron.Valid(c, t) {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
 //协程启动cron进程
+//act exec 单次执行也通过此方法运行
 func doCronRoutine(cmd *Command) {
 	if cmd.Pid() > 0 {
-		log.Println("cron ignore " + cmd.ID())
+		logEvent(newEvent(LevelWarn, EventCronFire, cmd, "cron ignore "+cmd.ID()+" : still running"))
 		return
 	}
 
+	startAt := time.Now()
 	cmd.Start()
-	if cmd.Pid() > 0 {
-		log.Println("cron cmd id: " + cmd.ID() + " started")
-		_, err := cmd.Wait()
-		if err != nil {
-			log.Println("cron cmd id: " + cmd.ID() + " msg:" + err.Error())
+	if cmd.Pid() <= 0 {
+		recordRun(cmd, startAt, -1, RunResultFailed)
+		if cmd.IsCron() {
+			e := newEvent(LevelWarn, EventCronDone, cmd, "cron cmd id: "+cmd.ID()+" start failed").withExitCode(-1)
+			logEvent(e)
+			fireHooks(HookCronFailure, cmd, e, RunResultFailed)
 		}
+		return
+	}
+	pid := cmd.Pid()
+	metricStarted(cmd, false)
+	e := newEvent(LevelInfo, EventStart, cmd, "cron cmd id: "+cmd.ID()+" started")
+	logEvent(e)
+	fireHooks(HookStart, cmd, e, "")
+	//超时后先发送停止信号 等待后仍未退出则强制杀死
+	var timedOut int32
+	var timer *time.Timer
+	if cmd.Timeout() > 0 {
+		timer = time.AfterFunc(cmd.Timeout(), func() {
+			atomic.StoreInt32(&timedOut, 1)
+			logEvent(newEvent(LevelWarn, EventTimeout, cmd, "cron cmd id: "+cmd.ID()+" timeout after "+cmd.Timeout().String()+", stopping"))
+			if err := cmd.Stop(); err != nil {
+				logEvent(newEvent(LevelError, EventTimeout, cmd, "cron cmd id: "+cmd.ID()+" stop error : "+err.Error()))
+			}
+		})
+	}
+	state, err := cmd.Wait()
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		logEvent(newEvent(LevelError, EventCronDone, cmd, "cron cmd id: "+cmd.ID()+" msg:"+err.Error()).withPid(pid))
+	}
+
+	exitCode := -1
+	if state != nil {
+		exitCode = state.ExitCode()
+	}
+	result := RunResultSuccess
+	level := LevelInfo
+	if atomic.LoadInt32(&timedOut) == 1 {
+		result = RunResultTimeout
+		level = LevelWarn
+	} else if exitCode != 0 {
+		result = RunResultFailed
+		level = LevelWarn
+	}
+	metricExited(cmd, exitCode)
+	setLastExit(cmd.Name(), pid, exitCode)
+	e = newEvent(level, EventCronDone, cmd, "cron cmd id: "+cmd.ID()+" "+result+" code:"+strconv.Itoa(exitCode)).withPid(pid).withExitCode(exitCode)
+	logEvent(e)
+	recordRun(cmd, startAt, exitCode, result)
+	fireHooks(HookExit, cmd, e, result)
+	if result != RunResultSuccess && cmd.IsCron() {
+		fireHooks(HookCronFailure, cmd, e, result)
 	}
 
-	cmd.pid = -1
+	cmd.setPid(-1)
+}
+
+//记录一次执行结果
+func recordRun(cmd *Command, startAt time.Time, exitCode int, result string) {
+	endAt := time.Now()
+	metricRun(cmd, result, endAt.Sub(startAt))
+	cmd.addRun(RunRecord{
+		StartTime: formatDate(startAt.Unix()),
+		EndTime:   formatDate(endAt.Unix()),
+		Duration:  endAt.Sub(startAt).String(),
+		ExitCode:  exitCode,
+		Result:    result,
+	})
 }
 
 //单独处理命令操作
@@ -378,7 +631,7 @@ func doCtlCmdAction() {
 	case sigExit:
 		cid, ok := findCmdIDByName(act.cmdid)
 		if ok {
-			if cmd, ok := cmds[cid]; ok {
+			if cmd, ok := cmdByID(cid); ok {
 				go exitSingleTask(cid, cmd)
 				return
 			}
@@ -387,16 +640,13 @@ func doCtlCmdAction() {
 	case sigExec:
 		cid, ok := findCmdIDByName(act.cmdid)
 		if ok {
-			if cmd, ok := cmds[cid]; ok {
-				if cmd.isCron {
-					go runDeamonRoutine(cid, cmd)
-				} else {
-					go doCronRoutine(cmd)
-				}
+			if cmd, ok := cmdByID(cid); ok {
+				//单次执行 与cron使用同一套超时处理
+				go doCronRoutine(cmd)
 				break
 			}
 		}
-		log.Println("ctl action exit error : no cmd found -- " + act.cmdid)
+		log.Println("ctl action exec error : no cmd found -- " + act.cmdid)
 	case sigReload:
 		cid, ok := findCmdIDByName(act.cmdid)
 		if ok {
@@ -407,10 +657,15 @@ func doCtlCmdAction() {
 	case sigStart:
 		cid, ok := findCmdIDByName(act.cmdid)
 		if ok {
-			if cmd, ok := cmds[cid]; ok {
+			if cmd, ok := cmdByID(cid); ok {
 				cmd.SetRun()
+				setCmdPaused(cmd.Name(), false)
+				logEvent(newEvent(LevelInfo, EventResume, cmd, "cmd:"+cmd.ID()+" resumed"))
 				if !cmd.isCron {
 					go runDeamonRoutine(cid, cmd)
+				} else {
+					//恢复后补偿暂停期间错过的执行
+					catchUpCron(cmd)
 				}
 				break
 			}
@@ -419,8 +674,10 @@ func doCtlCmdAction() {
 	case sigPause:
 		cid, ok := findCmdIDByName(act.cmdid)
 		if ok {
-			if cmd, ok := cmds[cid]; ok {
+			if cmd, ok := cmdByID(cid); ok {
 				cmd.SetPause()
+				setCmdPaused(cmd.Name(), true)
+				logEvent(newEvent(LevelInfo, EventPause, cmd, "cmd:"+cmd.ID()+" paused"))
 				if !cmd.isCron {
 					go exitSingleTask(cid, cmd)
 				}
@@ -1,6 +1,8 @@
 package taskeeper
 
 import (
+	"bufio"
+	"bytes"
 	"io"
 	"log"
 	"net"
@@ -9,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -35,13 +38,18 @@ const (
 
 //定义一些常量 错误编号
 const (
-	ErrResCodeNo  = iota //无错误 0
-	ErrResWrgMsg         //消息结构不正确 1
-	ErrResUdfCtl         //未定义的操作命令 2
-	ErrResMissCmd        //缺少命令ID 3
-	ErrResStatNil        //未获取到合法的参数 4
-	ErrResWrgSig         //未定义的信号 5
-	ErrResCtlSig         //缺少需要重启的命令id 6
+	ErrResCodeNo    = iota //无错误 0
+	ErrResWrgMsg           //消息结构不正确 1
+	ErrResUdfCtl           //未定义的操作命令 2
+	ErrResMissCmd          //缺少命令ID 3
+	ErrResStatNil          //未获取到合法的参数 4
+	ErrResWrgSig           //未定义的信号 5
+	ErrResCtlSig           //缺少需要重启的命令id 6
+	ErrResVersion          //不支持的协议版本 7
+	ErrResUdfMethod        //未定义的方法 8
+	ErrResNoCmd            //没有找到命令 9
+	ErrResAuth             //token校验失败 10
+	ErrResDenied           //没有执行权限 11
 )
 
 //ErrMsgMap 错误编号对应的消息数组
@@ -53,6 +61,11 @@ var ErrMsgMap = []string{
 	"found nil args",
 	"undefined signal",
 	"undefined restart cmd",
+	"unsupported protocol version",
+	"undefined method",
+	"cmd not found",
+	"unauthorized",
+	"permission denied",
 }
 
 //客户端操作命令常量
@@ -66,17 +79,21 @@ var (
 	SigMap map[string]int
 	//StatArgsMap 信号参数map
 	StatArgsMap []string
+	//StatCmdOutput 查询命令最近的输出 `stat cmd {id} output`
+	StatCmdOutput string
 	//serviceDonw 结束服务通道
 	serviceDonw chan bool
-	//unixServer unix下的服务 .sock启动 暂未启用
+	//unixServer unix下的服务 .sock启动
 	unixServer *net.UnixListener
-	//tcpServer 所有环境下启动tcp服务
+	//tcpServer tcp服务 windows下总是启动 unix下配置了host或port时启动
 	tcpServer *net.TCPListener
 	//signalChan 信号通道
 	signalChan chan int
 	//sysSigChan 监听系统命令 ctl+c kill 等
 	sysSigChan chan os.Signal
-	//msgProcessLock 消息处理锁
+	//hupSigChan 监听SIGHUP 重新打开日志文件
+	hupSigChan chan os.Signal
+	//msgProcessLock 消息处理锁 控制请求依次处理 不保护cmds
 	msgProcessLock sync.Mutex
 	//signalCmdCtlChan 命令单独控制通道
 	signalCmdCtlChan chan cmdCtlAction
@@ -91,6 +108,7 @@ type cmdCtlAction struct {
 func init() {
 	signalChan = make(chan int)
 	sysSigChan = make(chan os.Signal)
+	hupSigChan = make(chan os.Signal, 1)
 	serviceDonw = make(chan bool)
 	signalCmdCtlChan = make(chan cmdCtlAction, 10)
 	SigMap = map[string]int{
@@ -105,21 +123,25 @@ func init() {
 		"cmdlist",
 		"server",
 		"config",
+		"audit",
 	}
+	StatCmdOutput = "output"
 }
 
 //启动监听服务
 //接收客户端的消息
+//unix系统默认启动unix socket 配置了host或port时同时启动tcp
 func startListenService() {
-	//windows下暂时不做处理
 	switch runtime.GOOS {
 	case "windows":
 		tcpListen()
-	//macos和linux 启动unix通信
 	case "darwin", "linux":
-		tcpListen()
-		//		unixListen()
+		unixListen()
+		if tcpEnabled {
+			tcpListen()
+		}
 	}
+	httpListen()
 }
 
 //启动tcp通信
@@ -135,14 +157,16 @@ func tcpListen() {
 		log.Fatalln("tcp listen start faild : " + err.Error())
 	}
 
+	//开启tls时 连接在处理时完成握手
+	ln := tlsListener(tcpServer)
 	go func() {
 		for {
-			c, err := tcpServer.AcceptTCP()
+			c, err := ln.Accept()
 			if err != nil {
 				if _, ok := err.(*net.OpError); ok {
 					break
 				}
-				log.Printf("unix listen accept error : %s\n", err.Error())
+				log.Printf("tcp listen accept error : %s\n", err.Error())
 				continue
 			}
 
@@ -153,10 +177,32 @@ func tcpListen() {
 }
 
 //处理消息
+//以 `{` 开头的消息按json协议逐行处理 其他按旧的文本协议处理
 func listenHandle(c net.Conn) {
+	p := connPeer(c)
+	reader := bufio.NewReader(c)
 	for {
+		head, err := reader.Peek(1)
+		if err == nil && head[0] == '{' {
+			var line []byte
+			line, err = reader.ReadBytes('\n')
+			//订阅请求会持续推送事件 单独处理
+			if req, ok := isSubscribeRequest(line); ok {
+				streamSubscribe(c, reader, p, req)
+				return
+			}
+			if len(bytes.TrimSpace(line)) > 0 {
+				c.Write(handleRequest(p, line))
+			}
+			if err == nil {
+				continue
+			}
+		}
 		var buf = make([]byte, 1024)
-		n, err := c.Read(buf)
+		var n int
+		if err == nil {
+			n, err = reader.Read(buf)
+		}
 		if err != nil {
 			if err != io.EOF {
 				log.Println("tcp client error:" + err.Error())
@@ -164,8 +210,23 @@ func listenHandle(c net.Conn) {
 			c.Close()
 			break
 		}
-		msg, errcode, format := msgProcess(buf[:n])
-		bytes := getResponseBytes(errcode, msg, format)
+		token, msg := splitLegacyToken(buf[:n])
+		//tail请求会持续输出内容 单独处理
+		if args, ok := isTailMsg(msg); ok {
+			ta, _ := parseTailArgs(args)
+			start := time.Now()
+			identity, errmsg, errcode := p.authorize(token, StatTail, ta.name)
+			auditRequest(p, identity, StatTail, ta.name, errcode, start)
+			if errcode != ErrResCodeNo {
+				c.Write(getResponseBytes(errcode, errmsg, false))
+				c.Close()
+				return
+			}
+			streamTail(c, args)
+			return
+		}
+		res, errcode, format := peerMsgProcess(p, token, msg)
+		bytes := getResponseBytes(errcode, res, format)
 		c.Write(bytes)
 	}
 
@@ -175,11 +236,20 @@ func listenHandle(c net.Conn) {
 func unixListen() {
 	log.Println("unix listen service starting ...")
 	var err error
+	//删除上次异常退出时残留的sock文件
+	if info, err := os.Lstat(sockPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(sockPath)
+	}
 	unixServer, err = net.ListenUnix("unix", &net.UnixAddr{Name: sockPath, Net: "unix"})
 	if err != nil {
 		log.Fatalln("unix listen start faild : " + err.Error())
 	}
 	unixServer.SetUnlinkOnClose(true)
+	//通过文件权限控制访问
+	if err = setSocketPerm(sockPath); err != nil {
+		unixServer.Close()
+		log.Fatalln("unix listen set permission faild : " + err.Error())
+	}
 
 	go func() {
 		for {
@@ -195,7 +265,7 @@ func unixListen() {
 			go listenHandle(c)
 		}
 	}()
-	log.Println("unix listen service started")
+	log.Println("unix listen service started at " + sockPath)
 }
 
 //处理客户端消息内容
@@ -204,11 +274,14 @@ func unixListen() {
 //`ctl reload|exit `
 //`stat cmd id`
 //`stat cmdlist`
+//`stat audit [n]`
 //`stat server`
 func msgProcess(msg []byte) (interface{}, int, bool) {
+	return peerMsgProcess(localPeer, "", msg)
+}
 
-	msgProcessLock.Lock()
-	defer msgProcessLock.Unlock()
+//处理客户端的文本消息 校验token后执行
+func peerMsgProcess(p *peer, token string, msg []byte) (interface{}, int, bool) {
 	format := false
 	argStart := 1
 
@@ -233,16 +306,13 @@ func msgProcess(msg []byte) (interface{}, int, bool) {
 	if format && len(data) < 3 {
 		return ErrMsgMap[ErrResWrgMsg] + " : {" + msgStr + "}", ErrResWrgMsg, false
 	}
-	//匹配命令类型
-	switch data[0] {
-	case MsgSigCtl:
-		msg, errcode := sendSignal(data[argStart:]...)
-		return msg, errcode, format
-	case MsgSigStat:
-		msg, errcode := sendStat(data[argStart:]...)
-		return msg, errcode, format
+	//转换为json协议的方法后统一处理
+	method, params, errmsg, errcode := legacyMethod(data[0], data[argStart:])
+	if errcode != ErrResCodeNo {
+		return errmsg, errcode, false
 	}
-	return ErrMsgMap[ErrResUdfCtl] + " : {" + data[0] + "}", ErrResUdfCtl, false
+	res, errcode := dispatch(p, token, method, params)
+	return res, errcode, format
 }
 
 //状态查询方法
@@ -254,6 +324,10 @@ func sendStat(s ...string) (interface{}, int) {
 			msg = ErrMsgMap[ErrResMissCmd]
 			return msg, ErrResMissCmd
 		}
+		if len(s) > 2 && s[2] == StatCmdOutput {
+			msg = getCmdOutput(s[1])
+			break
+		}
 		msg = getCmd(s[1])
 	case StatArgsMap[1]:
 		msg = getCmdList()
@@ -261,6 +335,12 @@ func sendStat(s ...string) (interface{}, int) {
 		msg = getRunningStatus()
 	case StatArgsMap[3]:
 		msg = getProcessConfig()
+	case StatArgsMap[4]:
+		var n int
+		if len(s) > 1 {
+			n, _ = strconv.Atoi(s[1])
+		}
+		msg = readAudit(n)
 	}
 
 	if msg != nil {
@@ -302,6 +382,7 @@ func sendSignal(ss ...string) (msg string, errcode int) {
 					log.Println(msg + " error :" + err.Error())
 					errcode = ErrResCtlSig
 				} else {
+					logEvent(newEvent(LevelInfo, EventCtl, nil, "ctl "+strings.Join(ss, " ")))
 					signalCmdCtlChan <- cmdCtlAction{ctlAction, ss[2]}
 					signalChan <- sig
 				}
@@ -309,6 +390,7 @@ func sendSignal(ss ...string) (msg string, errcode int) {
 		default:
 			errcode = 0
 			msg = "ok"
+			logEvent(newEvent(LevelInfo, EventCtl, nil, "ctl "+s))
 			signalChan <- sig
 		}
 
@@ -327,9 +409,16 @@ func stopListenSerivce() {
 	case "darwin", "linux":
 		if unixServer != nil {
 			unixServer.Close()
+			unixServer = nil
 			log.Println("unix listen service stopped")
 		}
 	}
+	if tcpServer != nil {
+		tcpServer.Close()
+		tcpServer = nil
+		log.Println("tcp listen service stopped")
+	}
+	stopHTTPListen()
 }
 
 //启动一个协程 监听系统信号
@@ -340,4 +429,16 @@ func listenSystemSig() {
 		log.Println("system signal :" + sig.String())
 		signalChan <- sigExit
 	}()
+	//收到SIGHUP后重新打开所有日志文件 配合外部的切割工具使用
+	go func() {
+		for sig := range hupSigChan {
+			log.Println("system signal :" + sig.String() + " reopen log files")
+			if !logRotate.enabled() && len([]byte(logPath)) > 0 {
+				if err := setOutput(logPath); err != nil {
+					log.Println("reopen log error : " + err.Error())
+				}
+			}
+			reopenRotateWriters()
+		}
+	}()
 }
@@ -0,0 +1,94 @@
+package taskeeper
+
+import (
+	"errors"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//DefaultSocketMode unix socket文件的默认权限 只允许keeper的运行用户访问
+const DefaultSocketMode os.FileMode = 0600
+
+var (
+	//socketMode unix socket文件的权限
+	socketMode = DefaultSocketMode
+	//socketOwner unix socket文件的所有者 `user` 或 `user:group` 为空时不修改
+	socketOwner string
+)
+
+//读取unix socket的配置
+//socket_path 文件路径 socket_mode 八进制权限字符串 socket_owner 所有者
+func loadSocketConfig(cnf *configurator.Config) error {
+	if p, _ := cnf.Get("socket_path").String(); p != "" {
+		sockPath = getAbsPath(p)
+	}
+	socketMode = DefaultSocketMode
+	if !cnf.Get("socket_mode").IsNil() {
+		modeStr, err := cnf.Get("socket_mode").String()
+		if err != nil {
+			return errors.New("socket_mode error : need a quoted octal string like \"0660\"")
+		}
+		mode, err := strconv.ParseUint(modeStr, 8, 32)
+		if err != nil || mode > 0777 {
+			return errors.New("socket_mode error : invalid mode " + modeStr)
+		}
+		socketMode = os.FileMode(mode)
+	}
+	socketOwner, _ = cnf.Get("socket_owner").String()
+	if socketOwner != "" {
+		if _, _, err := lookupOwner(socketOwner); err != nil {
+			return errors.New("socket_owner error : " + err.Error())
+		}
+	}
+	return nil
+}
+
+//设置socket文件的权限和所有者
+func setSocketPerm(path string) error {
+	if err := os.Chmod(path, socketMode); err != nil {
+		return err
+	}
+	if socketOwner == "" {
+		return nil
+	}
+	uid, gid, err := lookupOwner(socketOwner)
+	if err != nil {
+		return err
+	}
+	return os.Chown(path, uid, gid)
+}
+
+//解析 `user` 或 `user:group` 用户和组可以是名称或者数字id
+//只配置用户时使用用户的主组
+func lookupOwner(owner string) (int, int, error) {
+	parts := strings.SplitN(owner, ":", 2)
+	u, err := user.Lookup(parts[0])
+	if err != nil {
+		if u, err = user.LookupId(parts[0]); err != nil {
+			return 0, 0, err
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gidStr := u.Gid
+	if len(parts) > 1 && parts[1] != "" {
+		g, err := user.LookupGroup(parts[1])
+		if err != nil {
+			if g, err = user.LookupGroupId(parts[1]); err != nil {
+				return 0, 0, err
+			}
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
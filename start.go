@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
 	"os"
@@ -12,6 +13,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -38,10 +41,16 @@ var (
 	configHost string
 	//tcp 启动端口 例如 127.0.0.1:17101
 	configPort string
+	//tcpEnabled 是否启动tcp服务
+	tcpEnabled bool
 	//启动时载入的config文件结构
 	configRaw *configurator.Config
 	//主程序输出打印位置
-	output = os.Stdout
+	output io.WriteCloser = os.Stdout
+	//主程序日志文件的切割配置
+	logRotate RotateConfig
+	//命令最近输出的默认内存缓存大小
+	outputBufferSize int64
 	//存储config中配置的命令列表
 	cmds map[string]*Command
 	//自定义的容忍间隔
@@ -56,6 +65,8 @@ var (
 	cPidPath string
 	//主程序启动的描述文件
 	pidDescPath string
+	//运行状态持久化文件 与pid文件放在同一目录
+	statePath string
 	//DefaultLogPath 默认主程序日志打印位置
 	DefaultLogPath string
 	//主程序工作目录
@@ -66,6 +77,9 @@ var (
 	MainPid int
 	//命令的名称对应id关系
 	cmdNameMap map[string]string
+	//cmds和cmdNameMap的读写锁 重载配置时整体替换 替换后不再修改
+	//只在读取和替换时持有 持有时不能发送信号
+	cmdsLock sync.RWMutex
 	//AutoStart 自动启动命令
 	AutoStart bool
 )
@@ -82,6 +96,7 @@ func init() {
 		pidPath = os.Getenv("TEMP") + "\\taskeeper.pid"
 		cPidPath = os.Getenv("TEMP") + "\\taskeeper.childs.pid"
 		pidDescPath = os.Getenv("TEMP") + "\\taskeeper.pid.desc"
+		statePath = os.Getenv("TEMP") + "\\taskeeper.state"
 		DefaultLogPath = os.Getenv("TEMP") + "\\taskeeper.log"
 	case "darwin", "linux":
 		_, err := os.Stat(UnixSysRunDir)
@@ -90,11 +105,13 @@ func init() {
 			pidPath = UnixSysRunDir + "taskeeper.pid"
 			cPidPath = UnixSysRunDir + "taskeeper.childs.pid"
 			pidDescPath = UnixSysRunDir + "taskeeper.pid.desc"
+			statePath = UnixSysRunDir + "taskeeper.state"
 		} else {
 			sockPath = UnixSysTmpDir + "taskeeper.sock"
 			pidPath = UnixSysTmpDir + "taskeeper.pid"
 			cPidPath = UnixSysTmpDir + "taskeeper.childs.pid"
 			pidDescPath = UnixSysTmpDir + "taskeeper.pid.desc"
+			statePath = UnixSysTmpDir + "taskeeper.state"
 		}
 		DefaultLogPath = "/tmp/taskeeper.log"
 	}
@@ -129,7 +146,11 @@ func Start(configPath string, deamon, forceLog bool) {
 		//Getppid 获取父进程进程id
 		if os.Getppid() != 1 {
 			cmdName := checkCommand(os.Args[0])
-			cmd := NewCommand(cmdName, []string{"-c", configPath, "-flog", "-w", workDir}, "")
+			args := []string{"-c", configPath, "-flog", "-w", workDir}
+			if IgnoreState {
+				args = append(args, "-ignore-state")
+			}
+			cmd := NewCommand(cmdName, args, "")
 			pid := cmd.Start()
 			if pid > 0 {
 				fmt.Printf("+[%d]\n", cmd.Pid())
@@ -139,36 +160,31 @@ func Start(configPath string, deamon, forceLog bool) {
 		fmt.Printf("%s\n", "process can not started by child process")
 		return
 	}
-	//读取配置文件内容
-	err = readConfig(configPath)
-	if err != nil {
-		log.Println("read config error :" + err.Error())
+	//读取配置文件内容 配置有误时进程不能启动 不会以不完整的鉴权和tls配置开启监听
+	if configErr := readConfig(configPath); configErr != nil {
+		log.Println("check workdir : " + workDir)
+		log.Fatalln("config file error : " + configErr.Error())
 	}
+	applyLogOutput(output)
 	//更改打印输出位置
 	if len([]byte(logPath)) > 0 {
 		//设置主输出
 		err = setOutput(logPath)
-		if err != nil {
-			log.Println("set output error :" + err.Error())
-		}
 	} else {
 		//如果这是后台模式启动的守护进程 且没有配置输出地址
 		//将启用默认配置的日志路径
 		if forceLog {
 			err = setOutput(DefaultLogPath)
-			if err != nil {
-				log.Println("set output error :" + err.Error())
-			}
 			logPath = DefaultLogPath
 		}
 	}
-	//如果配置文件有误 进程不能启动
+	//日志位置不可用时 进程不能启动
 	if err != nil {
-		log.Println("check workdir : " + workDir)
-		log.Fatalln("config file error : " + err.Error())
+		log.Fatalln("set output error : " + err.Error())
 	}
 	//开启监听服务 接收管理客户端命令
 	signal.Notify(sysSigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(hupSigChan, syscall.SIGHUP)
 	startListenService()
 	//监听系统信号
 	listenSystemSig()
@@ -182,46 +198,30 @@ func Start(configPath string, deamon, forceLog bool) {
 //读取配置文件内容 如果出错则会管理进程成
 func reloadConfigs() error {
 	cfgRaw, err := configurator.NewConfig(configName, configRaw.Path())
-
 	if err != nil {
-		return nil
+		return err
+	}
+	//tls只在启动时加载 配置有误时拒绝重载
+	if _, _, err = buildTLSConfig(cfgRaw); err != nil {
+		return err
 	}
 	//读取注册的命令 以及参数设置
 	commands, err := cfgRaw.Get("cmds").Array()
 	if err != nil {
 		return err
 	}
+	hooks, err := buildHooks(cfgRaw, true)
+	if err != nil {
+		return err
+	}
 	if len(commands) > 0 {
-		cmds = make(map[string]*Command)
-		for _, cmdmap := range commands {
-			cnf := configurator.BuildConfig(cmdmap)
-			cmd, _ := cnf.Get("cmd").String()
-			cmd = getAbsPath(cmd)
-			output, _ := cnf.Get("output").String()
-			output = getAbsPath(output)
-			args, _ := cnf.Get("args").ArrayString()
-			if len([]byte(cmd)) > 0 {
-				c := NewCommand(cmd, args, output)
-				cron, _ := cnf.Get("cron").String()
-				name, _ := cnf.Get("name").String()
-
-				if len([]byte(cron)) > 0 {
-					c.SetCron(cron)
-				}
-				c.SetID(createID())
-
-				//如果设置了命令的名称则使用 否则使用命令随机的id作为name
-				if name != "" {
-					c.SetName(name)
-				} else {
-					c.SetName(c.ID())
-				}
-				//注册命令名称到存储映射 方便查询
-				cmdNameMap[c.Name()] = c.ID()
-
-				cmds[c.ID()] = c
-			}
+		//全部解析成功后再替换 避免配置错误时丢失正在使用的命令
+		newCmds, newNameMap, err := loadCommands(commands)
+		if err != nil {
+			return err
 		}
+		setCmds(newCmds, newNameMap)
+		setGlobalHooks(hooks)
 		return nil
 	}
 	return errors.New("no legal command registered")
@@ -253,6 +253,31 @@ func readConfig(filename string) error {
 	if err != nil {
 		log.Println(err.Error())
 	}
+	if err = checkSyslogPath(logPath); err != nil {
+		return errors.New("log " + err.Error())
+	}
+	//加载keeper日志的切割配置
+	logRotate, err = buildRotateConfig(configRaw)
+	if err != nil {
+		return err
+	}
+	//加载日志格式和级别
+	logFmt, _ := configRaw.Get("log_format").String()
+	logLvl, _ := configRaw.Get("log_level").String()
+	if err = setLogOptions(logFmt, logLvl); err != nil {
+		return err
+	}
+	//加载syslog的地址和facility
+	sysAddr, _ := configRaw.Get("syslog_addr").String()
+	sysFacility, _ := configRaw.Get("syslog_facility").String()
+	if err = setSyslogOptions(sysAddr, sysFacility); err != nil {
+		return err
+	}
+	//加载命令输出内存缓存的默认大小
+	outputBufferSize, err = getSize(configRaw.Get("output_buffer"))
+	if err != nil {
+		return errors.New("output_buffer error : " + err.Error())
+	}
 	//加载允许访问的host
 	if !configRaw.Get("host").IsNil() {
 		configHost, _ = configRaw.Get("host").String()
@@ -262,6 +287,21 @@ func readConfig(filename string) error {
 		wdir, _ := configRaw.Get("workdir").String()
 		SetWorkDir(wdir)
 	}
+	//加载tcp和http访问的token
+	if err = loadAuthConfig(configRaw); err != nil {
+		return err
+	}
+	//加载用户和角色
+	if err = loadRBACConfig(configRaw); err != nil {
+		return err
+	}
+	//加载tcp和http服务的tls配置
+	if err = loadTLSConfig(configRaw); err != nil {
+		return err
+	}
+	//鉴权和tls加载成功后 再加载监听的地址
+	//配置了host或port时启动tcp服务
+	tcpEnabled = !configRaw.Get("host").IsNil() || !configRaw.Get("port").IsNil()
 	//加载启用的端口
 	if !configRaw.Get("port").IsNil() {
 		if port, err := configRaw.Get("port").Int(); err == nil {
@@ -271,6 +311,34 @@ func readConfig(filename string) error {
 			configPort = configHost + ":" + portStr
 		}
 	}
+	//加载unix socket的路径和权限
+	if err = loadSocketConfig(configRaw); err != nil {
+		return err
+	}
+	//加载审计日志的位置
+	loadAuditConfig(configRaw)
+	//加载http控制接口的地址 不配置时不启动
+	httpAddr, _ = configRaw.Get("http").String()
+
+	//加载cgroup子树的位置
+	loadCgroupConfig(configRaw)
+
+	//加载全局的钩子
+	hooks, err := buildHooks(configRaw, true)
+	if err != nil {
+		return err
+	}
+	setGlobalHooks(hooks)
+
+	//加载进程资源的采样间隔
+	interval, err := getDuration(configRaw.Get("resource_interval"))
+	if err != nil {
+		return errors.New("resource_interval error : " + err.Error())
+	}
+	if interval <= 0 {
+		interval = DefaultProcInterval
+	}
+	procInterval = interval
 
 	//加载容错时间
 	brokenGap, err := configRaw.Get("broken_gap").Int()
@@ -287,61 +355,206 @@ func readConfig(filename string) error {
 	}
 
 	if len(commands) > 0 {
-		for _, cmdmap := range commands {
-			cnf := configurator.BuildConfig(cmdmap)
-			cmd, _ := cnf.Get("cmd").String()
-			cmd = getAbsPath(cmd)
-			output, _ := cnf.Get("output").String()
-			output = getAbsPath(output)
-			args, _ := cnf.Get("args").ArrayString()
-			if len([]byte(cmd)) > 0 {
-				c := NewCommand(cmd, args, output)
-
-				cron, _ := cnf.Get("cron").String()
-				if len([]byte(cron)) > 0 {
-					c.SetCron(cron)
-				}
-				c.SetID(createID())
-
-				name, _ := cnf.Get("name").String()
-				//如果设置了命令的名称则使用 否则使用命令随机的id作为name
-				if name != "" {
-					c.SetName(name)
-				} else {
-					c.SetName(c.ID())
-				}
-				//注册命令名称到存储映射 方便查询
-				cmdNameMap[c.Name()] = c.ID()
-
-				cmds[c.ID()] = c
-
-			}
+		newCmds, newNameMap, err := loadCommands(commands)
+		if err != nil {
+			return err
 		}
+		setCmds(newCmds, newNameMap)
 		return nil
 	}
 	return errors.New("no legal command registered")
 }
 
+//按照配置列表创建命令 返回命令map和名称映射
+func loadCommands(commands []interface{}) (map[string]*Command, map[string]string, error) {
+	newCmds := make(map[string]*Command)
+	newNameMap := make(map[string]string)
+	for _, cmdmap := range commands {
+		c, err := buildCommand(configurator.BuildConfig(cmdmap))
+		if err != nil {
+			return nil, nil, err
+		}
+		if c == nil {
+			continue
+		}
+		c.SetID(createID())
+		//如果设置了命令的名称则使用 否则使用命令随机的id作为name
+		if c.Name() == "" {
+			c.SetName(c.ID())
+		}
+		//注册命令名称到存储映射 方便查询
+		newNameMap[c.Name()] = c.ID()
+
+		newCmds[c.ID()] = c
+	}
+	return newCmds, newNameMap, nil
+}
+
+//解析单个命令的配置项
+//如果没有配置cmd 返回nil
+func buildCommand(cnf *configurator.Config) (*Command, error) {
+	cmd, _ := cnf.Get("cmd").String()
+	if len([]byte(cmd)) == 0 {
+		return nil, nil
+	}
+	cmd = getAbsPath(cmd)
+	output, _ := cnf.Get("output").String()
+	stdout, _ := cnf.Get("stdout").String()
+	stderr, _ := cnf.Get("stderr").String()
+	for _, p := range []string{output, stdout, stderr} {
+		if err := checkSyslogPath(p); err != nil {
+			return nil, errors.New("cmd " + cmd + " " + err.Error())
+		}
+	}
+	args, _ := cnf.Get("args").ArrayString()
+	c := NewCommand(cmd, args, getOutputPath(output))
+	c.SetStdout(getOutputPath(stdout))
+	if stderr == StderrToStdout {
+		c.SetStderr(StderrToStdout)
+	} else {
+		c.SetStderr(getOutputPath(stderr))
+	}
+
+	cron, _ := cnf.Get("cron").String()
+	if len([]byte(cron)) > 0 {
+		c.SetCron(cron)
+	}
+	name, _ := cnf.Get("name").String()
+	c.SetName(name)
+	//命令分组 用于按分组授权
+	group, _ := cnf.Get("group").String()
+	c.SetGroup(group)
+
+	//单次执行的超时时间
+	timeout, err := getDuration(cnf.Get("timeout"))
+	if err != nil {
+		return nil, errors.New("cmd " + cmd + " timeout error : " + err.Error())
+	}
+	c.SetTimeout(timeout)
+	//停止信号以及等待退出的时间
+	var sig os.Signal
+	if sigName, _ := cnf.Get("stop_signal").String(); sigName != "" {
+		sig, err = parseSignal(sigName)
+		if err != nil {
+			return nil, errors.New("cmd " + cmd + " stop_signal error : " + err.Error())
+		}
+	}
+	wait, err := getDuration(cnf.Get("stop_wait"))
+	if err != nil {
+		return nil, errors.New("cmd " + cmd + " stop_wait error : " + err.Error())
+	}
+	c.SetStopSignal(sig, wait)
+
+	//错过执行时间后的补偿策略
+	catchUp, _ := cnf.Get("catch_up").String()
+	switch catchUp {
+	case "", CatchUpNone, CatchUpLatest, CatchUpAll:
+	default:
+		return nil, errors.New("cmd " + cmd + " catch_up error : undefined policy " + catchUp)
+	}
+	deadline, err := getDuration(cnf.Get("starting_deadline"))
+	if err != nil {
+		return nil, errors.New("cmd " + cmd + " starting_deadline error : " + err.Error())
+	}
+	c.SetCatchUp(catchUp, deadline)
+
+	//输出文件切割
+	rc, err := buildRotateConfig(cnf)
+	if err != nil {
+		return nil, errors.New("cmd " + cmd + " " + err.Error())
+	}
+	c.SetRotate(rc)
+
+	//按行处理输出 为每行加上前缀
+	linePrefix, _ := cnf.Get("log_prefix").String()
+	timeFormat, _ := cnf.Get("log_time_format").String()
+	c.SetLinePrefix(linePrefix, timeFormat)
+
+	//最近输出的内存缓存 未配置时使用全局配置
+	bufSize := outputBufferSize
+	if !cnf.Get("output_buffer").IsNil() {
+		bufSize, err = getSize(cnf.Get("output_buffer"))
+		if err != nil {
+			return nil, errors.New("cmd " + cmd + " output_buffer error : " + err.Error())
+		}
+	}
+	c.SetOutputBuffer(int(bufSize))
+
+	//常驻命令的内存和cpu上限
+	if err = buildWatchdog(c, cnf); err != nil {
+		return nil, errors.New("cmd " + cmd + " " + err.Error())
+	}
+
+	//命令的cgroup限制
+	cg, err := buildCgroup(cnf)
+	if err != nil {
+		return nil, errors.New("cmd " + cmd + " " + err.Error())
+	}
+	c.SetCgroup(cg)
+
+	//子进程的资源限制
+	limits, err := buildLimits(cnf)
+	if err != nil {
+		return nil, errors.New("cmd " + cmd + " " + err.Error())
+	}
+	c.SetLimits(limits)
+
+	//进程状态变化时触发的钩子
+	hooks, err := buildHooks(cnf, false)
+	if err != nil {
+		return nil, errors.New("cmd " + cmd + " " + err.Error())
+	}
+	c.SetHooks(hooks)
+	return c, nil
+}
+
 //更改输出打印位置
 func setOutput(logPath string) (err error) {
 	if len([]byte(logPath)) == 0 {
 		return errors.New("log path empty ,output did not change")
 	}
-	var newOutput *os.File
-	newOutput, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		return err
+	var newOutput io.WriteCloser
+	if isSyslogPath(logPath) {
+		//输出到syslog 不需要切割
+		newOutput = newSyslogWriter(syslogTag(logPath, DefaultSyslogTag), strconv.Itoa(MainPid), severityInfo)
+	} else if logRotate.enabled() {
+		//开启切割后 日志文件由切割文件管理
+		w := getRotateWriter(logPath, logRotate)
+		if err = w.Reopen(); err != nil {
+			return err
+		}
+		newOutput = w
+	} else {
+		newOutput, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0755)
+		if err != nil {
+			return err
+		}
 	}
-	log.SetOutput(newOutput)
-
 	//关闭之前的打印接收资源
-	if output != nil {
-		output.Close()
-	}
+	oldOutput := output
 	output = newOutput
+	applyLogOutput(newOutput)
+	if oldOutput != nil && oldOutput != os.Stdout && oldOutput != newOutput {
+		oldOutput.Close()
+	}
 	return nil
 }
 
+//补充输出位置的路径
+//为空时打印到主程序输出 /dev/null 转换为当前系统的空设备
+func getOutputPath(p string) string {
+	if p == "" {
+		return ""
+	}
+	if p == "/dev/null" || p == os.DevNull {
+		return os.DevNull
+	}
+	if isSyslogPath(p) {
+		return p
+	}
+	return getAbsPath(p)
+}
+
 //补充工作路径
 func getAbsPath(p string) string {
 	if !path.IsAbs(p) {
@@ -367,7 +580,7 @@ func createID() string {
 			result.WriteString(temp)
 			i++
 		}
-		if _, ok := cmds[result.String()]; ok {
+		if _, ok := cmdByID(result.String()); ok {
 			continue
 		}
 		randSeed++
@@ -375,6 +588,22 @@ func createID() string {
 	}
 }
 
+//SetRunDir 设置pid sock state等运行文件所在的目录
+//同一台机器上运行多个keeper时 需要分别设置
+func SetRunDir(dir string) bool {
+	info, err := os.Stat(dir)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+	dir = strings.TrimRight(dir, sysDirSep) + sysDirSep
+	sockPath = dir + "taskeeper.sock"
+	pidPath = dir + "taskeeper.pid"
+	cPidPath = dir + "taskeeper.childs.pid"
+	pidDescPath = dir + "taskeeper.pid.desc"
+	statePath = dir + "taskeeper.state"
+	return true
+}
+
 //SetWorkDir 外部设置工作目录
 //如果是绝对路径 直接赋值
 //如果是相对路径 则按照当前目录为起始获取绝对路径
@@ -2,15 +2,40 @@ package taskeeper
 
 import (
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
 
+//测试时将pid sock state和审计日志放到临时目录 结束后恢复
+func useTempRunDir(t *testing.T) string {
+	oldSock, oldPid, oldCPid, oldDesc := sockPath, pidPath, cPidPath, pidDescPath
+	oldState, oldAudit := statePath, auditPath
+	t.Cleanup(func() {
+		sockPath, pidPath, cPidPath, pidDescPath = oldSock, oldPid, oldCPid, oldDesc
+		statePath, auditPath = oldState, oldAudit
+	})
+	dir := t.TempDir()
+	if !SetRunDir(dir) {
+		t.Fatal("set run dir failed")
+	}
+	auditPath = ""
+	return dir
+}
+
 func TestStart(t *testing.T) {
+	useTempRunDir(t)
 	ok := SetWorkDir("keeper")
 	t.Log("set workdir ", ok)
-	go Start("config/config.yml", false, false)
-	time.Sleep(1 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		Start("config/config.yml", false, false)
+		close(done)
+	}()
+	//等待命令启动后的第一次状态同步
+	for i := 0; i < 100 && currentState().TasksNum == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
 
 	msg, errcode := sendSignal("reload")
 	t.Log(msg, errcode)
@@ -25,10 +50,39 @@ func TestStart(t *testing.T) {
 	t.Log("runstatus:", rs)
 	cmdList := getCmdList()
 	t.Log("cmd list :", cmdList)
-	for id := range cmds {
-		msgProcess([]byte(`stat cmd ` + id))
+	var first *Command
+	all, _ := currentCmds()
+	for _, c := range all {
+		first = c
 		break
 	}
+	if first != nil {
+		msgProcess([]byte(`stat cmd ` + first.ID()))
+
+		//重载配置和其他控制请求同时处理时不能互相阻塞
+		ctlDone := make(chan struct{})
+		go func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				dispatch(localPeer, "", MethodReload, RequestParams{})
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 5; i++ {
+					dispatch(localPeer, "", MethodRestart, RequestParams{Name: first.Name()})
+				}
+			}()
+			wg.Wait()
+			close(ctlDone)
+		}()
+		select {
+		case <-ctlDone:
+		case <-time.After(10 * time.Second):
+			t.Fatal("reload and ctl requests blocked each other")
+		}
+	}
 
 	t.Log(GetPidFile())
 	t.Log(GetChildPidsFile())
@@ -51,7 +105,11 @@ func TestStart(t *testing.T) {
 
 	msg, errcode = sendSignal("exit")
 	t.Log(msg, errcode)
-
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("keeper not exited")
+	}
 }
 
 func TestGetFuncs(t *testing.T) {
@@ -67,6 +125,7 @@ func TestGetFuncs(t *testing.T) {
 }
 
 func TestUnixSock(t *testing.T) {
+	useTempRunDir(t)
 
 	unixListen()
 	time.Sleep(1 * time.Second)
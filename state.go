@@ -9,12 +9,16 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	//StateCopy 监控服务状态的备份 用于返回客户端查询请求
 	StateCopy CopyState
+	//stateCopyLock 状态备份的读写锁
+	stateCopyLock sync.RWMutex
 	//StartTime 监控服务启动时间
 	StartTime int64
 	//ReloadTime 监控服务重载的时间点
@@ -39,42 +43,81 @@ type CopyState struct {
 }
 
 //获取一个主程序运行状态的copy
+//在状态机的锁内复制各个map 备份不会再被命令协程修改
 func copyState() CopyState {
+	RunState.Numlock.Lock()
+	defer RunState.Numlock.Unlock()
 	rs := CopyState{}
-	rs.BrokenList = RunState.BrokenList
+	rs.BrokenList = copyCmdMap(RunState.BrokenList)
 	rs.BrokenNum = RunState.BrokenNum
-	rs.BrokenPoints = RunState.BrokenPoints
-	rs.BrokenTries = RunState.BrokenTries
+	rs.BrokenPoints = make(map[string]int64, len(RunState.BrokenPoints))
+	for id, ts := range RunState.BrokenPoints {
+		rs.BrokenPoints[id] = ts
+	}
+	rs.BrokenTries = make(map[string]int, len(RunState.BrokenTries))
+	for id, n := range RunState.BrokenTries {
+		rs.BrokenTries[id] = n
+	}
 	rs.CronState = RunState.CronState
-	rs.MinCronList = RunState.MinCronList
-	rs.RunningList = RunState.RunningList
+	rs.MinCronList = copyCmdMap(RunState.MinCronList)
+	rs.RunningList = copyCmdMap(RunState.RunningList)
 	rs.RunningNum = RunState.RunningNum
-	rs.SecCronList = RunState.SecCronList
+	rs.SecCronList = copyCmdMap(RunState.SecCronList)
 	rs.TasksNum = RunState.TasksNum
 	return rs
 }
 
-//同步主程序的运行状态
+//复制命令map
+func copyCmdMap(src map[string]*Command) map[string]*Command {
+	dst := make(map[string]*Command, len(src))
+	for id, c := range src {
+		dst[id] = c
+	}
+	return dst
+}
+
+//获取最近一次同步的运行状态
+func currentState() CopyState {
+	stateCopyLock.RLock()
+	defer stateCopyLock.RUnlock()
+	return StateCopy
+}
+
+//同步主程序的运行状态 Run退出时停止同步
 func syncStateToCopy() {
 	//每100毫秒同步一次运行状态 用于对客户端输出监控数据
 	//需要协程启动
+	runRoutines.Add(2)
 	go func() {
+		defer runRoutines.Done()
 		for {
-			StateCopy = copyState()
-			time.Sleep(100 * time.Millisecond)
+			rs := copyState()
+			stateCopyLock.Lock()
+			StateCopy = rs
+			stateCopyLock.Unlock()
+			select {
+			case <-runStop:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
 		}
 	}()
 	//每秒保存子进程的pid列表 写入文件
 	go func() {
+		defer runRoutines.Done()
 		for {
-			time.Sleep(1 * time.Second)
+			select {
+			case <-runStop:
+				return
+			case <-time.After(1 * time.Second):
+			}
 			file, err := os.OpenFile(cPidPath, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0666)
 			if err != nil {
 				log.Println("sync child pids error : " + err.Error())
 				return
 			}
 			var pids = make([]string, 0, 5)
-			for _, cmd := range StateCopy.RunningList {
+			for _, cmd := range currentState().RunningList {
 				pids = append(pids, strconv.Itoa(cmd.Pid()))
 			}
 			file.WriteString(strings.Join(pids, "|"))
@@ -111,34 +154,41 @@ type RunningStatus struct {
 	CronState   bool     `json:"cron_state"`       //是否已经开启cron协程
 	SecCronList []string `json:"second_cron_list"` //秒级cron列表
 	MinCronList []string `json:"minute_cron_list"` //分钟级cron列表
+
+	Subscribers int `json:"subscribers"` //事件的订阅者数量
 }
 
 //获取监控服务的运行状态
 func getRunningStatus() interface{} {
-	runSec := time.Now().Unix() - StartTime
+	startTime := atomic.LoadInt64(&StartTime)
+	runSec := time.Now().Unix() - startTime
 	runList := make([]string, 0, 5)
 	termList := make([]string, 0, 5)
 
-	for rid := range StateCopy.RunningList {
+	st := currentState()
+	RunState.Numlock.Lock()
+	totalTasks := RunState.TasksNum
+	RunState.Numlock.Unlock()
+	for rid := range st.RunningList {
 		runList = append(runList, rid)
 	}
-	for tid := range StateCopy.BrokenList {
+	for tid := range st.BrokenList {
 		termList = append(termList, tid)
 	}
-	stString := formatDate(StartTime)
+	stString := formatDate(startTime)
 	reloadTimeString := make([]string, 0, 10)
-	for _, tm := range ReloadTime {
+	for _, tm := range reloadTimes() {
 		reloadTimeString = append(reloadTimeString, formatDate(tm))
 	}
 
-	cronState := StateCopy.CronState
+	cronState := st.CronState
 	secCron := make([]string, 0, 5)
-	for sid := range StateCopy.SecCronList {
+	for sid := range st.SecCronList {
 		secCron = append(secCron, sid)
 	}
 
 	minCron := make([]string, 0, 5)
-	for mid := range StateCopy.MinCronList {
+	for mid := range st.MinCronList {
 		minCron = append(minCron, mid)
 	}
 
@@ -146,32 +196,44 @@ func getRunningStatus() interface{} {
 		Pid:            MainPid,
 		StartTime:      stString,
 		ReloadTime:     reloadTimeString,
-		TotalTasks:     RunState.TasksNum,
+		TotalTasks:     totalTasks,
 		RunningTasks:   runList,
 		TermTasks:      termList,
 		RunningSeconds: formatSeconds(runSec),
 		CronState:      cronState,
 		SecCronList:    secCron,
 		MinCronList:    minCron,
+		Subscribers:    subscriberCount(),
 	}
 }
 
 //CmdStatus 单个子程序的运行状态信息
 type CmdStatus struct {
-	ID         string `json:"id"`               //命令id
-	Name       string `json:"name"`             //命令名称
-	Pid        int    `json:"pid"`              //命令pid
-	Cmd        string `json:"cmd"`              //命令的启动参数
-	Output     string `json:"output"`           //命令输出的打印位置
-	BkTimes    int    `json:"brokens"`          //中断次数
-	LastBkTime string `json:"last_broken_time"` //上一次中断的时间
-	IsCron     bool   `json:"is_cron"`          //是否是cron
+	ID         string `json:"id"`                //命令id
+	Name       string `json:"name"`              //命令名称
+	Group      string `json:"group"`             //命令分组
+	Pid        int    `json:"pid"`               //命令pid
+	Cmd        string `json:"cmd"`               //命令的启动参数
+	Output     string `json:"output"`            //命令输出的打印位置
+	Stdout     string `json:"stdout"`            //标准输出的打印位置
+	Stderr     string `json:"stderr"`            //错误输出的打印位置
+	BkTimes    int    `json:"brokens"`           //中断次数
+	Restarts   uint64 `json:"restarts"`          //进程退出后的自动重启次数
+	WdRestarts uint64 `json:"watchdog_restarts"` //资源超限后的重启次数
+	LastBkTime string `json:"last_broken_time"`  //上一次中断的时间
+	Crashes    int    `json:"crashes"`           //常驻命令异常退出的累计次数 keeper重启后保留
+	Paused     bool   `json:"paused"`            //是否已暂停
+	IsCron     bool   `json:"is_cron"`           //是否是cron
+	Timeout    string `json:"timeout"`           //单次执行的超时时间
+
+	LastExit *ExitInfo         `json:"last_exit,omitempty"` //最后一次退出的信息 keeper重启后保留
+	Runs     []RunRecord       `json:"runs"`                //最近的运行记录
+	Usage    *ProcUsage        `json:"usage,omitempty"`     //运行中的进程树的资源使用
+	Limits   map[string]string `json:"limits,omitempty"`    //资源限制 运行中时为实际生效的限制
 }
 
 //按照id 获取单个cmd的运行状态
 func getCmd(cid string) interface{} {
-	var cmdCopy Command
-
 	var id = ""
 	var ok = false
 	//先查找name
@@ -182,30 +244,48 @@ func getCmd(cid string) interface{} {
 	}
 	//如果找到了id
 	if ok {
-		if cmd, ok := cmds[id]; ok {
+		if cmd, ok := cmdByID(id); ok {
 			var bktimes int
 			var lastbk int64
-			if _, ok := StateCopy.BrokenTries[id]; ok {
-				bktimes = StateCopy.BrokenTries[id]
-				lastbk = StateCopy.BrokenPoints[id]
+			st := currentState()
+			if _, ok := st.BrokenTries[id]; ok {
+				bktimes = st.BrokenTries[id]
+				lastbk = st.BrokenPoints[id]
 			}
 
-			cmdCopy = *cmd
 			var bk = "null"
 			if lastbk > 0 {
 				bk = time.Unix(lastbk, 0).Format("2006-01-02 15:04:05")
 			}
 
-			cmdStr := cmdCopy.cmd + " " + strings.Join(cmdCopy.args, " ")
+			var timeout = "null"
+			if cmd.Timeout() > 0 {
+				timeout = cmd.Timeout().String()
+			}
+
+			restarts, wdRestarts := cmdRestarts(cmd)
+			cmdStr := cmd.cmd + " " + strings.Join(cmd.args, " ")
 			return CmdStatus{
-				ID:         cmdCopy.ID(),
-				Pid:        cmdCopy.Pid(),
-				Name:       cmdCopy.Name(),
-				Output:     cmdCopy.Output(),
+				ID:         cmd.ID(),
+				Pid:        cmd.Pid(),
+				Name:       cmd.Name(),
+				Group:      cmd.Group(),
+				Output:     cmd.Output(),
+				Stdout:     cmd.Stdout(),
+				Stderr:     cmd.Stderr(),
 				BkTimes:    bktimes,
+				Restarts:   restarts,
+				WdRestarts: wdRestarts,
 				LastBkTime: bk,
+				Crashes:    getCrashes(cmd.Name()),
+				Paused:     cmd.IsPause(),
+				LastExit:   getLastExit(cmd.Name()),
 				Cmd:        cmdStr,
-				IsCron:     cmdCopy.IsCron(),
+				IsCron:     cmd.IsCron(),
+				Timeout:    timeout,
+				Runs:       cmd.Runs(),
+				Usage:      cmdUsage(cmd),
+				Limits:     cmdLimits(cmd),
 			}
 		}
 	}
@@ -213,9 +293,47 @@ func getCmd(cid string) interface{} {
 	return nil
 }
 
+//按照id或名称 获取命令内存缓存中最近的输出
+func getCmdOutput(cid string) interface{} {
+	id, ok := findCmdIDByName(cid)
+	if !ok {
+		id, ok = findCmdID(cid)
+	}
+	if cmd, found := cmdByID(id); ok && found {
+		if cmd.outputRing == nil {
+			return "output buffer is disabled"
+		}
+		return string(cmd.RecentOutput())
+	}
+	log.Println("runnning state error getCmdOutput : can not find cmd id `" + cid + "`")
+	return nil
+}
+
+//当前的命令列表和名称对应关系 替换后不会被修改 可以直接遍历
+func currentCmds() (map[string]*Command, map[string]string) {
+	cmdsLock.RLock()
+	defer cmdsLock.RUnlock()
+	return cmds, cmdNameMap
+}
+
+//替换命令列表和名称对应关系
+func setCmds(list map[string]*Command, names map[string]string) {
+	cmdsLock.Lock()
+	cmds, cmdNameMap = list, names
+	cmdsLock.Unlock()
+}
+
+//按完整的id获取命令
+func cmdByID(id string) (*Command, bool) {
+	list, _ := currentCmds()
+	cmd, ok := list[id]
+	return cmd, ok
+}
+
 //按传入的id片段 查找完整的命令id
 func findCmdID(id string) (string, bool) {
-	for k := range cmds {
+	list, _ := currentCmds()
+	for k := range list {
 		if strings.HasPrefix(k, id) {
 			return k, true
 		}
@@ -225,7 +343,8 @@ func findCmdID(id string) (string, bool) {
 
 //根据传入的name片段 查找完整的命令id
 func findCmdIDByName(name string) (string, bool) {
-	for nm, id := range cmdNameMap {
+	_, names := currentCmds()
+	for nm, id := range names {
 		if strings.HasPrefix(nm, name) {
 			return id, true
 		}
@@ -236,7 +355,8 @@ func findCmdIDByName(name string) (string, bool) {
 // 获取所有cmdList的运行状态
 func getCmdList() interface{} {
 	var list = make([]interface{}, 0, 5)
-	for id := range cmds {
+	all, _ := currentCmds()
+	for id := range all {
 		cmd := getCmd(id)
 		if cmd != nil {
 			list = append(list, getCmd(id))
@@ -380,6 +500,8 @@ type ProcessConfig struct {
 	ConfigPath string `json:"conf_path"`
 	//TCPAddr Tcp启动地址
 	TCPAddr string `json:"tcp_addr"`
+	//HTTPAddr http控制接口地址
+	HTTPAddr string `json:"http_addr,omitempty"`
 	//PidFile Pid文件地址
 	PidFile string `json:"pid_file"`
 	//pidDesc Pid描述文件
@@ -388,6 +510,8 @@ type ProcessConfig struct {
 	SockFile string `json:"sock_file"`
 	//ChdFile 子进程pid统一存储路径
 	ChdFile string `json:"child_pids"`
+	//StateFile 运行状态持久化文件
+	StateFile string `json:"state_file"`
 	//LogFile 主程序日志打印位置
 	LogFile string `json:"log_file"`
 }
@@ -396,16 +520,21 @@ type ProcessConfig struct {
 func getProcessConfig() interface{} {
 	pconf := ProcessConfig{
 		ConfigPath: configRaw.Path(),
-		TCPAddr:    configPort,
+		HTTPAddr:   httpAddr,
 		PidFile:    pidPath,
 		ChdFile:    cPidPath,
+		StateFile:  statePath,
 		LogFile:    logPath,
 		pidDesc:    pidDescPath,
 	}
 	switch runtime.GOOS {
 	case "windows":
+		pconf.TCPAddr = configPort
 	case "darwin", "linux":
 		pconf.SockFile = sockPath
+		if tcpEnabled {
+			pconf.TCPAddr = configPort
+		}
 	}
 	return pconf
 }
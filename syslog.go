@@ -0,0 +1,271 @@
+package taskeeper
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//SyslogScheme 输出到syslog的路径前缀 `syslog://{tag}`
+	SyslogScheme = "syslog://"
+	//DefaultSyslogAddr 默认的本地syslog地址
+	DefaultSyslogAddr = "/dev/log"
+	//DefaultSyslogTag keeper日志的默认tag
+	DefaultSyslogTag = "taskeeper"
+	//单条消息的最大长度 超过后截断
+	syslogMaxMsgSize = 8192
+	//RFC5424中APP-NAME的最大长度
+	syslogMaxTagSize = 48
+)
+
+//syslog的严重级别
+const (
+	severityErr     = 3
+	severityWarning = 4
+	severityInfo    = 6
+	severityDebug   = 7
+)
+
+//syslog的facility
+var syslogFacilities = map[string]int{
+	"kern":   0,
+	"user":   1,
+	"mail":   2,
+	"daemon": 3,
+	"auth":   4,
+	"syslog": 5,
+	"cron":   9,
+	"local0": 16,
+	"local1": 17,
+	"local2": 18,
+	"local3": 19,
+	"local4": 20,
+	"local5": 21,
+	"local6": 22,
+	"local7": 23,
+}
+
+//日志级别对应的严重级别
+var levelSeverity = map[string]int{
+	LevelDebug: severityDebug,
+	LevelInfo:  severityInfo,
+	LevelWarn:  severityWarning,
+	LevelError: severityErr,
+}
+
+var (
+	//syslogNetwork syslog的连接类型 为空时先尝试unixgram再尝试unix
+	syslogNetwork string
+	//syslogAddress syslog的连接地址
+	syslogAddress = DefaultSyslogAddr
+	//syslogFacility 使用的facility 默认daemon
+	syslogFacility = syslogFacilities["daemon"]
+	//syslogHostname 消息中的主机名
+	syslogHostname = "-"
+)
+
+func init() {
+	if name, err := os.Hostname(); err == nil && name != "" {
+		syslogHostname = name
+	}
+}
+
+//判断输出位置是否是syslog
+func isSyslogPath(p string) bool {
+	return strings.HasPrefix(p, SyslogScheme)
+}
+
+//获取syslog路径中的tag
+//未配置tag时使用默认值 默认值中不能作为APP-NAME的字符替换为_
+func syslogTag(p string, def string) string {
+	tag := strings.TrimPrefix(p, SyslogScheme)
+	if tag == "" {
+		return sanitizeSyslogTag(def)
+	}
+	return tag
+}
+
+//检查syslog路径中配置的tag
+//tag作为RFC5424的APP-NAME 只能包含可打印的ASCII字符 不能包含空格
+func checkSyslogPath(p string) error {
+	if !isSyslogPath(p) {
+		return nil
+	}
+	tag := strings.TrimPrefix(p, SyslogScheme)
+	if len(tag) > syslogMaxTagSize {
+		return errors.New("syslog tag error : " + tag + " longer than " + strconv.Itoa(syslogMaxTagSize))
+	}
+	for i := 0; i < len(tag); i++ {
+		if tag[i] <= ' ' || tag[i] > '~' {
+			return errors.New("syslog tag error : " + strconv.Quote(tag) + " contains space or non-printable character")
+		}
+	}
+	return nil
+}
+
+//将不能作为APP-NAME的字符替换为_ 超长时截断 为空时使用-
+func sanitizeSyslogTag(tag string) string {
+	if tag == "" {
+		return "-"
+	}
+	b := []byte(tag)
+	for i := range b {
+		if b[i] <= ' ' || b[i] > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > syslogMaxTagSize {
+		b = b[:syslogMaxTagSize]
+	}
+	return string(b)
+}
+
+//子进程输出来源对应的严重级别 标准错误为err 标准输出为info
+func streamSeverity(stream string) int {
+	if stream == streamStderr {
+		return severityErr
+	}
+	return severityInfo
+}
+
+//设置syslog的连接地址和facility
+//地址支持 unix:///dev/log unixgram:///dev/log udp://127.0.0.1:514 以及直接使用路径
+func setSyslogOptions(addr, facility string) error {
+	syslogNetwork = ""
+	syslogAddress = DefaultSyslogAddr
+	if addr != "" {
+		if idx := strings.Index(addr, "://"); idx > 0 {
+			syslogNetwork = addr[:idx]
+			syslogAddress = addr[idx+3:]
+			switch syslogNetwork {
+			case "unix", "unixgram", "udp", "tcp":
+			default:
+				return errors.New("syslog_addr error : undefined network " + syslogNetwork)
+			}
+		} else {
+			syslogAddress = addr
+		}
+	}
+	syslogFacility = syslogFacilities["daemon"]
+	if facility != "" {
+		f, ok := syslogFacilities[strings.ToLower(facility)]
+		if !ok {
+			return errors.New("syslog_facility error : undefined facility " + facility)
+		}
+		syslogFacility = f
+	}
+	return nil
+}
+
+//syslogWriter 以RFC5424格式写入syslog 每一行作为一条消息
+type syslogWriter struct {
+	tag      string
+	procID   string
+	severity int
+	lock     sync.Mutex
+	conn     net.Conn
+}
+
+//创建一个syslog输出
+func newSyslogWriter(tag string, procID string, severity int) *syslogWriter {
+	if procID == "" {
+		procID = "-"
+	}
+	return &syslogWriter{tag: tag, procID: procID, severity: severity}
+}
+
+//Write 按行写入 使用默认的严重级别
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	return w.writeSeverity(w.severity, p)
+}
+
+//按指定的严重级别写入
+func (w *syslogWriter) writeSeverity(severity int, p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if err := w.send(severity, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//Close 关闭连接
+func (w *syslogWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+//发送一条消息 连接断开时重新连接一次
+func (w *syslogWriter) send(severity int, msg string) error {
+	if len(msg) > syslogMaxMsgSize {
+		msg = msg[:syslogMaxMsgSize]
+	}
+	line := formatSyslog(syslogFacility, severity, time.Now(), w.tag, w.procID, msg)
+	for i := 0; i < 2; i++ {
+		if w.conn == nil {
+			conn, err := dialSyslog()
+			if err != nil {
+				return err
+			}
+			w.conn = conn
+		}
+		data := []byte(line)
+		if isStreamConn(w.conn) {
+			//流式连接按换行分隔消息
+			data = append(data, '\n')
+		}
+		if _, err := w.conn.Write(data); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return errors.New("syslog write failed")
+}
+
+//连接syslog
+func dialSyslog() (net.Conn, error) {
+	if syslogNetwork != "" {
+		return net.Dial(syslogNetwork, syslogAddress)
+	}
+	conn, err := net.Dial("unixgram", syslogAddress)
+	if err == nil {
+		return conn, nil
+	}
+	return net.Dial("unix", syslogAddress)
+}
+
+//判断是否是流式连接 tcp和unix连接中的消息没有边界
+func isStreamConn(conn net.Conn) bool {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return false
+	}
+	switch addr.Network() {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return true
+	}
+	return false
+}
+
+//按RFC5424格式化消息
+//<PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+func formatSyslog(facility, severity int, t time.Time, tag, procID, msg string) string {
+	msg = strings.TrimRight(msg, "\r")
+	return "<" + strconv.Itoa(facility*8+severity) + ">1 " +
+		t.Format("2006-01-02T15:04:05.000000Z07:00") + " " +
+		syslogHostname + " " + tag + " " + procID + " - - " + msg
+}
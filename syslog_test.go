@@ -0,0 +1,118 @@
+package taskeeper
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCmdSyslogOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("need unix socket")
+	}
+	dir, err := ioutil.TempDir("", "taskeeper-syslog")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	sock := dir + "/log.sock"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	if err = setSyslogOptions("unixgram://"+sock, "local3"); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer setSyslogOptions("", "")
+
+	cmd := NewCommand("/bin/sh", []string{"-c", "echo out; echo err >&2"}, SyslogScheme+"echo")
+	pid := cmd.Start()
+	if pid <= 0 {
+		t.Fatal("start failed")
+	}
+	cmd.Wait()
+
+	var msgs []string
+	buf := make([]byte, syslogMaxMsgSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(msgs) < 2 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("read syslog %s, got %q", err.Error(), msgs)
+		}
+		msgs = append(msgs, string(buf[:n]))
+	}
+	sort.Strings(msgs)
+	//local3(19)*8 + err(3) = 155 local3*8 + info(6) = 158
+	if !strings.HasPrefix(msgs[0], "<155>1 ") || !strings.HasSuffix(msgs[0], " echo "+strconv.Itoa(pid)+" - - err") {
+		t.Fatalf("stderr message %q", msgs[0])
+	}
+	if !strings.HasPrefix(msgs[1], "<158>1 ") || !strings.HasSuffix(msgs[1], " - - out") {
+		t.Fatalf("stdout message %q", msgs[1])
+	}
+}
+
+func TestSyslogStreamFraming(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("need unix socket")
+	}
+	dir, err := ioutil.TempDir("", "taskeeper-syslog")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	sock := dir + "/log.sock"
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+	if err = setSyslogOptions("unix://"+sock, ""); err != nil {
+		t.Fatal(err.Error())
+	}
+	defer setSyslogOptions("", "")
+
+	w := newSyslogWriter("stream", "", severityInfo)
+	defer w.Close()
+	if _, err = w.Write([]byte("one\ntwo\n")); err != nil {
+		t.Fatal(err.Error())
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reader := bufio.NewReader(conn)
+	//流式连接中每条消息以换行结束
+	for _, want := range []string{" stream - - - one", " stream - - - two"} {
+		line, err := reader.ReadString('\n')
+		if err != nil || !strings.HasSuffix(line, want+"\n") {
+			t.Fatalf("message %q %v, want suffix %q", line, err, want)
+		}
+	}
+}
+
+func TestSyslogTag(t *testing.T) {
+	if err := checkSyslogPath(SyslogScheme + "web-app"); err != nil {
+		t.Error(err.Error())
+	}
+	for _, p := range []string{SyslogScheme + "web app", SyslogScheme + "web\tapp", SyslogScheme + "应用", SyslogScheme + strings.Repeat("a", syslogMaxTagSize+1)} {
+		if checkSyslogPath(p) == nil {
+			t.Errorf("tag %q accepted", p)
+		}
+	}
+	if tag := syslogTag(SyslogScheme, "my cmd"); tag != "my_cmd" {
+		t.Errorf("default tag %q", tag)
+	}
+}
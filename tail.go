@@ -0,0 +1,250 @@
+package taskeeper
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//StatTail 查询命令输出的最后几行 可以持续跟踪新的输出
+	//`stat tail {name} [-n 10] [-f] [-e]`
+	StatTail = "tail"
+	//DefaultTailLines 默认输出的行数
+	DefaultTailLines = 10
+	//跟踪文件时检查新内容的间隔
+	tailPollInterval = 200 * time.Millisecond
+	//向前查找行时每次读取的大小
+	tailChunkSize = 4096
+)
+
+//tailArgs tail请求的参数
+type tailArgs struct {
+	name   string //命令名称或id
+	lines  int    //输出的行数
+	follow bool   //是否持续跟踪
+	stderr bool   //是否读取错误输出
+}
+
+//解析tail请求参数 参数不包含 `stat tail`
+func parseTailArgs(args []string) (tailArgs, error) {
+	ta := tailArgs{lines: DefaultTailLines}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-f":
+			ta.follow = true
+		case "-e":
+			ta.stderr = true
+		case "-n":
+			if i+1 >= len(args) {
+				return ta, errors.New("miss line number")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return ta, errors.New("invalid line number " + args[i+1])
+			}
+			ta.lines = n
+			i++
+		default:
+			ta.name = args[i]
+		}
+	}
+	if ta.name == "" {
+		return ta, errors.New(ErrMsgMap[ErrResMissCmd])
+	}
+	return ta, nil
+}
+
+//判断消息是否是tail请求 返回tail之后的参数
+func isTailMsg(msg []byte) ([]string, bool) {
+	data := strings.Fields(string(msg))
+	if len(data) > 0 && data[0] == MsgSigStat {
+		data = data[1:]
+		if len(data) > 0 && data[0] == "f" {
+			data = data[1:]
+		}
+		if len(data) > 0 && data[0] == StatTail {
+			return data[1:], true
+		}
+	}
+	return nil, false
+}
+
+//处理tail请求 先输出最后几行 需要跟踪时持续输出新内容直到客户端断开
+//响应以 `0|format:stream|\n` 开头 后面是原始的输出内容
+func streamTail(c net.Conn, args []string) {
+	defer c.Close()
+	ta, err := parseTailArgs(args)
+	if err != nil {
+		c.Write(getResponseBytes(ErrResMissCmd, err.Error(), false))
+		return
+	}
+	path, err := tailPath(ta)
+	if err != nil {
+		c.Write(getResponseBytes(ErrResStatNil, err.Error(), false))
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		c.Write(getResponseBytes(ErrResStatNil, "open output error : "+err.Error(), false))
+		return
+	}
+
+	c.Write([]byte(strconv.Itoa(ErrResCodeNo) + "|format:stream|\n"))
+	offset, err := writeLastLines(c, file, ta.lines)
+	if err != nil || !ta.follow {
+		file.Close()
+		return
+	}
+	//客户端断开后停止跟踪
+	stop := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, c)
+		close(stop)
+	}()
+	err = followFile(c, path, file, offset, stop)
+	if err != nil {
+		log.Println("tail " + path + " stopped : " + err.Error())
+	}
+}
+
+//获取需要读取的输出文件
+func tailPath(ta tailArgs) (string, error) {
+	id, ok := findCmdIDByName(ta.name)
+	if !ok {
+		id, ok = findCmdID(ta.name)
+	}
+	cmd, found := cmdByID(id)
+	if !ok || !found {
+		return "", errors.New("can not find cmd `" + ta.name + "`")
+	}
+	path := cmd.Stdout()
+	if ta.stderr {
+		path = cmd.Stderr()
+	}
+	if path == "" || path == os.DevNull || isSyslogPath(path) {
+		return "", errors.New("cmd `" + ta.name + "` output is not a file")
+	}
+	return path, nil
+}
+
+//输出文件的最后n行 返回读取结束的位置
+func writeLastLines(w io.Writer, file *os.File, n int) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	start := size
+	//从文件末尾向前查找 直到找到n个换行
+	found := 0
+	buf := make([]byte, tailChunkSize)
+	for start > 0 && found <= n {
+		readSize := int64(tailChunkSize)
+		if start < readSize {
+			readSize = start
+		}
+		start -= readSize
+		if _, err := file.ReadAt(buf[:readSize], start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		chunk := buf[:readSize]
+		//忽略文件末尾的换行
+		if start+readSize == size && len(chunk) > 0 && chunk[len(chunk)-1] == '\n' {
+			chunk = chunk[:len(chunk)-1]
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] == '\n' {
+				found++
+				if found == n {
+					start += int64(i) + 1
+					break
+				}
+			}
+		}
+		if found >= n {
+			break
+		}
+	}
+	if n == 0 {
+		start = size
+	}
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		return 0, err
+	}
+	written, err := io.CopyN(w, file, size-start)
+	return start + written, err
+}
+
+//持续读取文件新增的内容 结束时关闭文件
+//文件被切割(重新创建)时读完旧文件后打开新文件 文件被截断时从头读取
+func followFile(w io.Writer, path string, file *os.File, offset int64, stop <-chan struct{}) error {
+	defer func() {
+		file.Close()
+	}()
+	buf := make([]byte, 32*1024)
+	//读取到文件末尾
+	drain := func() error {
+		for {
+			n, err := file.ReadAt(buf, offset)
+			if n > 0 {
+				offset += int64(n)
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					return werr
+				}
+			}
+			if err == io.EOF || (err == nil && n == 0) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for {
+		if err := drain(); err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(tailPollInterval):
+		}
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		latest, err := os.Stat(path)
+		if err != nil {
+			//切割时文件可能暂时不存在
+			continue
+		}
+		if !os.SameFile(current, latest) {
+			newFile, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			//读完切割前写入旧文件的内容
+			if err := drain(); err != nil {
+				newFile.Close()
+				return err
+			}
+			file.Close()
+			file = newFile
+			offset = 0
+			continue
+		}
+		if current.Size() < offset {
+			offset = 0
+			if _, err := w.Write([]byte("\n[taskeeper] file truncated\n")); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package taskeeper
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//并发安全的输出缓存
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestTailFollow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskeeper-tail")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "out.log")
+	ioutil.WriteFile(name, []byte("l1\nl2\nl3\nl4\n"), 0644)
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	out := &syncBuffer{}
+	offset, err := writeLastLines(out, file, 2)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.String() != "l3\nl4\n" {
+		t.Fatalf("last lines %q", out.String())
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		followFile(out, name, file, offset, stop)
+		close(done)
+	}()
+	w := getRotateWriter(name, RotateConfig{})
+	w.Write([]byte("l5\n"))
+	time.Sleep(3 * tailPollInterval)
+	//切割后继续读取新文件
+	os.Rename(name, name+".1")
+	w.Reopen()
+	w.Write([]byte("l6\n"))
+	time.Sleep(3 * tailPollInterval)
+	close(stop)
+	<-done
+	w.Close()
+
+	if !strings.HasSuffix(out.String(), "l5\nl6\n") {
+		t.Fatalf("follow output %q", out.String())
+	}
+}
@@ -0,0 +1,128 @@
+package taskeeper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//tls握手的超时时间
+const tlsHandshakeTimeout = 10 * time.Second
+
+//权限级别的配置名称
+var permNames = map[string]int{
+	"none":  PermNone,
+	"read":  PermRead,
+	"admin": PermAdmin,
+}
+
+var (
+	//tlsConfig tcp和http服务的tls配置 为nil时不启用
+	tlsConfig *tls.Config
+	//tlsClientPerms 客户端证书CN对应的权限 `*` 匹配其他所有CN
+	tlsClientPerms map[string]int
+)
+
+//读取tls配置
+//tls_cert tls_key 服务端证书 tls_client_ca 校验客户端证书的CA tls_client_perms 客户端证书CN对应的权限
+//读取失败时保留之前的配置 不会回退为明文
+func loadTLSConfig(cnf *configurator.Config) error {
+	conf, perms, err := buildTLSConfig(cnf)
+	if err != nil {
+		return err
+	}
+	tlsConfig, tlsClientPerms = conf, perms
+	return nil
+}
+
+//解析tls配置 没有配置证书时返回nil
+func buildTLSConfig(cnf *configurator.Config) (*tls.Config, map[string]int, error) {
+	certFile, _ := cnf.Get("tls_cert").String()
+	keyFile, _ := cnf.Get("tls_key").String()
+	caFile, _ := cnf.Get("tls_client_ca").String()
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, nil, errors.New("tls_client_ca error : need tls_cert and tls_key")
+		}
+		return nil, nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil, errors.New("tls error : need both tls_cert and tls_key")
+	}
+	pair, err := tls.LoadX509KeyPair(getAbsPath(certFile), getAbsPath(keyFile))
+	if err != nil {
+		return nil, nil, errors.New("tls_cert error : " + err.Error())
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{pair},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile == "" {
+		return conf, nil, nil
+	}
+	data, err := ioutil.ReadFile(getAbsPath(caFile))
+	if err != nil {
+		return nil, nil, errors.New("tls_client_ca error : " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, nil, errors.New("tls_client_ca error : no certificate found")
+	}
+	conf.ClientCAs = pool
+	//没有证书的客户端仍然可以使用token
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+
+	perms := make(map[string]int)
+	list, _ := cnf.Get("tls_client_perms").MapString()
+	for cn, v := range list {
+		name, _ := v.(string)
+		perm, ok := permNames[name]
+		if !ok {
+			return nil, nil, errors.New("tls_client_perms error : undefined permission `" + name + "` for " + cn)
+		}
+		perms[cn] = perm
+	}
+	return conf, perms, nil
+}
+
+//是否开启了客户端证书校验
+func clientCertEnabled() bool {
+	return tlsConfig != nil && tlsConfig.ClientCAs != nil
+}
+
+//已校验的客户端证书对应的CN和权限
+func certPerm(state *tls.ConnectionState) (string, int) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return "", PermNone
+	}
+	cn := state.PeerCertificates[0].Subject.CommonName
+	if perm, ok := tlsClientPerms[cn]; ok {
+		return cn, perm
+	}
+	return cn, tlsClientPerms["*"]
+}
+
+//完成tls握手 读取客户端证书的权限
+func tlsPeer(c *tls.Conn, p *peer) {
+	c.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+	if err := c.Handshake(); err != nil {
+		logEvent(newEvent(LevelWarn, EventAuth, nil, "tls handshake failed "+p.addr+" : "+err.Error()))
+		return
+	}
+	state := c.ConnectionState()
+	p.identity, p.perm = certPerm(&state)
+}
+
+//按tls配置包装监听
+func tlsListener(ln net.Listener) net.Listener {
+	if tlsConfig == nil {
+		return ln
+	}
+	return tls.NewListener(ln, tlsConfig)
+}
@@ -0,0 +1,174 @@
+package taskeeper
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+//测试用的证书
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pair tls.Certificate
+}
+
+//生成证书 parent为nil时生成自签名的CA
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pair: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+//写入pem文件 返回证书和私钥的路径
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSClientPerms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "taskeeper-tls")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "test-ca", nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "keeper", ca, x509.ExtKeyUsageServerAuth)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := server.write(t, dir, "server")
+
+	oldConf, oldPerms := tlsConfig, tlsClientPerms
+	defer func() {
+		tlsConfig, tlsClientPerms = oldConf, oldPerms
+	}()
+	cnf := configurator.BuildConfig(map[string]interface{}{
+		"tls_cert":      certFile,
+		"tls_key":       keyFile,
+		"tls_client_ca": caFile,
+		"tls_client_perms": map[interface{}]interface{}{
+			"ops":       "admin",
+			"dashboard": "read",
+		},
+	})
+	if err = loadTLSConfig(cnf); err != nil {
+		t.Fatal(err.Error())
+	}
+	//读取失败时保留之前的配置
+	active := tlsConfig
+	bad := configurator.BuildConfig(map[string]interface{}{
+		"tls_cert": certFile,
+		"tls_key":  filepath.Join(dir, "missing.key"),
+	})
+	if err = loadTLSConfig(bad); err == nil || tlsConfig != active {
+		t.Fatal("broken tls config replaced the active config")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ln = tlsListener(ln)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go listenHandle(c)
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	call := func(client *testCert, method string) *ResponseError {
+		conf := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+		if client != nil {
+			conf.Certificates = []tls.Certificate{client.pair}
+		}
+		conn, err := tls.Dial("tcp", ln.Addr().String(), conf)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer conn.Close()
+		conn.Write([]byte(`{"v":1,"id":1,"method":"` + method + `"}` + "\n"))
+		line, err := bufio.NewReader(conn).ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		var resp Response
+		json.Unmarshal(line, &resp)
+		return resp.Error
+	}
+
+	ops := newTestCert(t, "ops", ca, x509.ExtKeyUsageClientAuth)
+	dashboard := newTestCert(t, "dashboard", ca, x509.ExtKeyUsageClientAuth)
+	other := newTestCert(t, "other", ca, x509.ExtKeyUsageClientAuth)
+	cases := []struct {
+		client *testCert
+		method string
+		code   int
+	}{
+		{nil, MethodCommands, ErrResAuth},
+		{other, MethodCommands, ErrResAuth},
+		{dashboard, MethodCommands, ErrResCodeNo},
+		{dashboard, MethodStop, ErrResDenied},
+		//通过校验后 缺少命令名称
+		{ops, MethodStop, ErrResMissCmd},
+	}
+	for _, c := range cases {
+		code := ErrResCodeNo
+		if e := call(c.client, c.method); e != nil {
+			code = e.Code
+		}
+		if code != c.code {
+			t.Errorf("client %v method %s code %d, want %d", c.client != nil, c.method, code, c.code)
+		}
+	}
+}
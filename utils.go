@@ -2,6 +2,7 @@ package taskeeper
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"math"
 	"math/rand"
@@ -9,7 +10,10 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
 )
 
 const (
@@ -30,9 +34,9 @@ func GetParentDir(p string) string {
 func getChar() string {
 	switch rand.Intn(3) {
 	case 0:
-		return string(65 + rand.Intn(90-65))
+		return string(rune(65 + rand.Intn(90-65)))
 	case 1:
-		return string(97 + rand.Intn(122-97))
+		return string(rune(97 + rand.Intn(122-97)))
 	default:
 		return strconv.Itoa(rand.Intn(9))
 	}
@@ -126,3 +130,121 @@ func checkCommand(cmd string) string {
 
 	return cmd
 }
+
+//可以配置的停止信号
+var signalNames = map[string]os.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+//解析信号名称 支持 SIGTERM TERM term 等写法
+func parseSignal(name string) (os.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig, ok := signalNames[name]; ok {
+		return sig, nil
+	}
+	return nil, errors.New("undefined signal " + name)
+}
+
+//读取时长配置
+//整数按秒处理 字符串按 time.ParseDuration 格式解析 例如 30s 5m
+func getDuration(cnf *configurator.Config) (time.Duration, error) {
+	if cnf.IsNil() {
+		return 0, nil
+	}
+	if i, err := cnf.Int(); err == nil {
+		return time.Duration(i) * time.Second, nil
+	}
+	s, err := cnf.String()
+	if err != nil {
+		return 0, errors.New("invalid duration type " + cnf.Type())
+	}
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("negative duration " + s)
+	}
+	return d, nil
+}
+
+//读取字节大小配置
+//整数按字节处理 字符串支持 K M G 后缀 例如 512K 100M 1G
+func getSize(cnf *configurator.Config) (int64, error) {
+	if cnf.IsNil() {
+		return 0, nil
+	}
+	if i, err := cnf.Int(); err == nil {
+		if i < 0 {
+			return 0, errors.New("negative size " + strconv.Itoa(i))
+		}
+		return int64(i), nil
+	}
+	s, err := cnf.String()
+	if err != nil {
+		return 0, errors.New("invalid size type " + cnf.Type())
+	}
+	return parseSize(s)
+}
+
+//解析字节大小字符串
+func parseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSuffix(s, "B")
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size " + size)
+	}
+	return n * unit, nil
+}
+
+//读取布尔配置 支持 true/false 以及 "true" "on" "yes" "1"
+func getBool(cnf *configurator.Config) bool {
+	v, err := cnf.Interface()
+	if err != nil {
+		return false
+	}
+	switch b := v.(type) {
+	case bool:
+		return b
+	case int:
+		return b != 0
+	case string:
+		switch strings.ToLower(b) {
+		case "true", "on", "yes", "1":
+			return true
+		}
+	}
+	return false
+}
+
+//判断文件是否存在
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
@@ -0,0 +1,111 @@
+package taskeeper
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	configurator "github.com/kasiss-liu/go-configurator"
+)
+
+var (
+	//watchLock 超限记录的锁
+	watchLock sync.Mutex
+	//watchOver 命令开始超限的时间 按命令id保存
+	watchOver = make(map[string]time.Time)
+)
+
+//SetWatchdog 设置常驻命令的资源上限 超限持续sustain后优雅重启
+//maxMemory为进程树的常驻内存字节数 maxCPU为cpu使用率 0为不限制
+func (c *Command) SetWatchdog(maxMemory uint64, maxCPU float64, sustain time.Duration) *Command {
+	c.maxMemory = maxMemory
+	c.maxCPU = maxCPU
+	c.watchSustain = sustain
+	return c
+}
+
+//是否开启了资源上限检查
+func (c *Command) watchEnabled() bool {
+	return c.maxMemory > 0 || c.maxCPU > 0
+}
+
+//读取命令的资源上限配置
+//max_memory 常驻内存上限 支持 K M G 后缀 max_cpu_percent cpu使用率上限 watch_sustain 超限持续的时间
+func buildWatchdog(c *Command, cnf *configurator.Config) error {
+	maxMemory, err := getSize(cnf.Get("max_memory"))
+	if err != nil {
+		return errors.New("max_memory error : " + err.Error())
+	}
+	var maxCPU float64
+	if v := cnf.Get("max_cpu_percent"); !v.IsNil() {
+		if i, err := v.Int(); err == nil {
+			maxCPU = float64(i)
+		} else if maxCPU, err = v.Float64(); err != nil {
+			return errors.New("max_cpu_percent error : " + err.Error())
+		}
+		if maxCPU < 0 {
+			return errors.New("max_cpu_percent error : negative value")
+		}
+	}
+	sustain, err := getDuration(cnf.Get("watch_sustain"))
+	if err != nil {
+		return errors.New("watch_sustain error : " + err.Error())
+	}
+	c.SetWatchdog(uint64(maxMemory), maxCPU, sustain)
+	return nil
+}
+
+//按采样结果检查常驻命令的资源上限
+//超限持续watch_sustain后 通过停止信号优雅停止进程 由常驻协程重新启动
+func checkWatchdog(c *Command, u *ProcUsage, now time.Time) {
+	if c.IsCron() || !c.watchEnabled() {
+		return
+	}
+	var reason string
+	switch {
+	case c.maxMemory > 0 && u.RSS > c.maxMemory:
+		reason = "rss " + strconv.FormatUint(u.RSS, 10) + " exceeds max_memory " + strconv.FormatUint(c.maxMemory, 10)
+	case c.maxCPU > 0 && u.CPUPercent > c.maxCPU:
+		reason = "cpu " + formatFloat(u.CPUPercent) + "% exceeds max_cpu_percent " + formatFloat(c.maxCPU)
+	}
+
+	watchLock.Lock()
+	if reason == "" {
+		delete(watchOver, c.ID())
+		watchLock.Unlock()
+		return
+	}
+	since, ok := watchOver[c.ID()]
+	if !ok {
+		since = now
+		watchOver[c.ID()] = now
+	}
+	if now.Sub(since) < c.watchSustain {
+		watchLock.Unlock()
+		return
+	}
+	delete(watchOver, c.ID())
+	watchLock.Unlock()
+
+	//已经在停止中
+	if !atomic.CompareAndSwapInt32(&c.watchdogStop, 0, 1) {
+		return
+	}
+	if c.watchSustain > 0 {
+		reason += " for " + now.Sub(since).String()
+	}
+	logEvent(newEvent(LevelWarn, EventWatchdog, c, "cmd:"+c.ID()+" "+reason+", restarting"))
+	go func() {
+		if err := c.Stop(); err != nil {
+			log.Println("cmd:" + c.ID() + " watchdog stop error : " + err.Error())
+		}
+	}()
+}
+
+//进程是否由资源上限检查停止 读取后清除标记
+func (c *Command) takeWatchdogStop() bool {
+	return atomic.SwapInt32(&c.watchdogStop, 0) == 1
+}
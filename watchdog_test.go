@@ -0,0 +1,97 @@
+package taskeeper
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchdogSustain(t *testing.T) {
+	c := NewCommand("/bin/true", nil, "")
+	c.SetID("wdsustain")
+	c.SetWatchdog(1000, 50, 10*time.Second)
+	now := time.Now()
+
+	checkWatchdog(c, &ProcUsage{RSS: 2000}, now)
+	checkWatchdog(c, &ProcUsage{RSS: 2000}, now.Add(5*time.Second))
+	if atomic.LoadInt32(&c.watchdogStop) != 0 {
+		t.Fatal("stopped before sustain window")
+	}
+	//恢复正常后重新计算超限时间
+	checkWatchdog(c, &ProcUsage{RSS: 500}, now.Add(6*time.Second))
+	checkWatchdog(c, &ProcUsage{CPUPercent: 80}, now.Add(7*time.Second))
+	checkWatchdog(c, &ProcUsage{CPUPercent: 80}, now.Add(12*time.Second))
+	if atomic.LoadInt32(&c.watchdogStop) != 0 {
+		t.Fatal("sustain window not reset")
+	}
+	checkWatchdog(c, &ProcUsage{CPUPercent: 80}, now.Add(17*time.Second))
+	if !c.takeWatchdogStop() {
+		t.Fatal("not stopped after sustain window")
+	}
+
+	//cron命令不检查
+	c.SetCron("* * * * *")
+	checkWatchdog(c, &ProcUsage{RSS: 2000}, now.Add(30*time.Second))
+	checkWatchdog(c, &ProcUsage{RSS: 2000}, now.Add(40*time.Second))
+	if c.takeWatchdogStop() {
+		t.Error("cron command stopped by watchdog")
+	}
+}
+
+func TestWatchdogRestart(t *testing.T) {
+	useTempRunDir(t)
+	oldState, oldStore := RunState, metricsStore
+	defer func() {
+		RunState, metricsStore = oldState, oldStore
+	}()
+	RunState = &State{}
+	initTask()
+	metricsStore = make(map[string]*cmdMetrics)
+
+	c := NewCommand("/bin/sleep", []string{"30"}, "")
+	c.SetID("wdrestart")
+	c.SetWatchdog(1000, 0, 0)
+	c.SetStopSignal(nil, time.Second)
+	done := make(chan struct{})
+	go func() {
+		runDeamonRoutine(c.ID(), c)
+		close(done)
+	}()
+	waitPid := func(old int) int {
+		for i := 0; i < 200; i++ {
+			if pid := c.Pid(); pid > 0 && pid != old {
+				return pid
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("process not started")
+		return 0
+	}
+	pid := waitPid(0)
+
+	checkWatchdog(c, &ProcUsage{RSS: 2000}, time.Now())
+	waitPid(pid)
+	restarts, watchdogs := cmdRestarts(c)
+	if restarts != 0 || watchdogs != 1 {
+		t.Errorf("restarts %d watchdog restarts %d", restarts, watchdogs)
+	}
+	RunState.Numlock.Lock()
+	tries := RunState.BrokenTries[c.ID()]
+	RunState.Numlock.Unlock()
+	if tries != 0 {
+		t.Errorf("watchdog restart counted as broken try : %d", tries)
+	}
+	if n := getCrashes(c.Name()); n != 0 {
+		t.Errorf("watchdog restart counted as crash : %d", n)
+	}
+
+	exitSingleTask(c.ID(), c)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("routine not exited")
+	}
+	if c.Pid() != 0 {
+		t.Errorf("pid not reset after exit : %d", c.Pid())
+	}
+}